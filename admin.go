@@ -0,0 +1,695 @@
+/*
+ This file contains the admin endpoints to deploy a new resources.zip while the webserver is running.
+ An uploaded zip file is extracted and imported into its own staging database by a background job.
+ The progress of the job is reported over server-sent events, the staged data can be previewed
+ and is published by switching the live database, so no restart is needed.
+ The live database is recorded in the configured database, so a restart keeps serving the published data.
+*/
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	databaseKey   = "database"  // gin context key for the database a request is served from
+	imagesKey     = "images"    // gin context key for the images the pages of a request link to
+	jobKey        = "job"       // gin context key for the upload job of a request
+	templatesKey  = "templates" // gin context key for the templates a request is rendered with
+	maxUploadSize = 512 << 20
+	// scopes of the admin tokens
+	scopeUpload  = "upload"
+	scopePreview = "preview"
+	scopePublish = "publish"
+	// states of an upload job
+	jobRunning   = "running"
+	jobReady     = "ready"
+	jobFailed    = "failed"
+	jobPublished = "published"
+	jobDiscarded = "discarded"
+)
+
+var (
+	// adminTokens maps every admin token to its scopes
+	adminTokens map[string][]string
+	jobs        = make(map[string]*uploadJob)
+	jobsMux     sync.Mutex
+	// publishMux makes sure only one job is published at a time
+	publishMux sync.Mutex
+)
+
+// jobEvent is one progress report of an upload job, it is sent as server-sent event
+type jobEvent struct {
+	Step     string    `json:"step"`
+	Message  string    `json:"message"`
+	Progress int       `json:"progress"`
+	Time     time.Time `json:"time"`
+}
+
+// jobStatus is the public state of an upload job
+type jobStatus struct {
+	ID       string     `json:"id"`
+	Status   string     `json:"status"`
+	Progress int        `json:"progress"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Events   []jobEvent `json:"events"`
+}
+
+// uploadJob extracts and imports an uploaded zip file into a staging database
+type uploadJob struct {
+	jobStatus
+	database string
+	dir      string
+	subs     map[chan jobEvent]struct{}
+	mu       sync.Mutex
+	// cancel stops the extraction and import, done is closed when they are over
+	cancel context.CancelFunc
+	done   chan struct{}
+	// images are the images of the zip file over the live ones and static serves them with the live static files
+	images fs.FS
+	static gin.HandlerFunc
+	// finished is when the job left the running state, finished jobs are forgotten after the job TTL
+	finished time.Time
+	// templates link to the pages of the preview, they are parsed again when liveTemplates are replaced
+	templates     *template.Template
+	liveTemplates *template.Template
+}
+
+// setupAdminRoutes sets up the admin routes if admin tokens are configured
+// finished jobs are forgotten after the job TTL while the server runs
+func setupAdminRoutes(router gin.IRouter) error {
+	tokens, err := parseAdminTokens(cfg.Admin.Tokens)
+	if err != nil {
+		return fmt.Errorf("invalid admin tokens: %w", err)
+	}
+	adminTokens = tokens
+	if len(adminTokens) == 0 {
+		appLog.Info("no admin tokens set, admin routes are disabled")
+		return nil
+	}
+	appLog.Debug("set up admin routes")
+	admin := router.Group("/admin")
+	admin.POST("/uploads", requireScope(scopeUpload), uploadHandler)
+	admin.GET("/jobs", requireScope(scopeUpload), jobsHandler)
+	admin.GET("/jobs/:jobID", requireScope(scopeUpload), jobMiddleware, jobHandler)
+	admin.GET("/jobs/:jobID/events", requireScope(scopeUpload), jobMiddleware, jobEventsHandler)
+	admin.DELETE("/jobs/:jobID", requireScope(scopeUpload), jobMiddleware, deleteJobHandler)
+	admin.POST("/jobs/:jobID/publish", requireScope(scopePublish), jobMiddleware, publishHandler)
+
+	// the preview uses the normal handlers with the staging database and the static files of the job
+	preview := admin.Group("/preview/:jobID", requireScope(scopePreview), jobMiddleware, previewMiddleware)
+	preview.GET("/", homeHandler)
+	preview.GET("/static/*filepath", previewStaticHandler)
+	// the links of the pages end with a slash with pretty URLs
+	preview.GET("/impressum", impressumHandler)
+	preview.GET("/impressum/", impressumHandler)
+	preview.GET("/project/:projectID", projectHandler)
+	preview.GET("/project/:projectID/", projectHandler)
+	preview.GET("/tool/:toolID", toolHandler)
+	preview.GET("/tool/:toolID/", toolHandler)
+	// the jobs of a previous run are gone, only their staging databases may be left
+	go dropStagingDatabases()
+	go expireJobs()
+	return nil
+}
+
+// parseAdminTokens parses the admin tokens in the format "token:scope+scope,token:scope"
+// the scope "*" grants all scopes
+func parseAdminTokens(value string) (map[string][]string, error) {
+	tokens := make(map[string][]string)
+	for i, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		token, scopes, found := strings.Cut(entry, ":")
+		if !found || token == "" || scopes == "" {
+			return nil, fmt.Errorf("admin token %d has no scopes", i+1)
+		}
+		tokens[token] = strings.Split(scopes, "+")
+	}
+	return tokens, nil
+}
+
+// requireScope returns a middleware that only lets requests pass with a token that has the given scope
+// the token is read from the Authorization header as bearer token or from the token query parameter
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Query("token")
+		if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		scopes, ok := lookupToken(token)
+		if !ok {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid token"})
+			return
+		}
+		for _, s := range scopes {
+			if s == scope || s == "*" {
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "token is missing scope " + scope})
+	}
+}
+
+// lookupToken returns the scopes of a token, the tokens are compared in constant time
+func lookupToken(token string) ([]string, bool) {
+	if token == "" {
+		return nil, false
+	}
+	for t, scopes := range adminTokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return scopes, true
+		}
+	}
+	return nil, false
+}
+
+// jobMiddleware looks up the job of the jobID parameter and stores it in the gin context
+func jobMiddleware(c *gin.Context) {
+	jobsMux.Lock()
+	job, ok := jobs[c.Param("jobID")]
+	jobsMux.Unlock()
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "job not found"})
+		return
+	}
+	c.Set(jobKey, job)
+	c.Next()
+}
+
+// previewMiddleware lets the preview requests use the staging database of the job
+func previewMiddleware(c *gin.Context) {
+	job := c.MustGet(jobKey).(*uploadJob)
+	switch job.status().Status {
+	case jobReady:
+		tmpl, err := job.previewTemplates()
+		if err != nil {
+			logFor(c.Request.Context()).Error("could not parse preview templates", "job", job.ID, "error", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "could not parse templates: " + err.Error()})
+			return
+		}
+		c.Set(databaseKey, job.database)
+		c.Set(imagesKey, job.images)
+		c.Set(templatesKey, tmpl)
+		// previews must not end up in shared caches or be confused with the live pages
+		c.Header("Cache-Control", "private, no-store")
+		c.Next()
+	case jobPublished:
+		// a published job is the live site
+		c.Redirect(http.StatusSeeOther, basePath()+"/")
+		c.Abort()
+	default:
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "job is not ready for preview", "job": job.status()})
+	}
+}
+
+// previewStaticHandler serves the images extracted from the zip file of the job,
+// all other files and the images the zip file does not contain are the ones of the live site
+func previewStaticHandler(c *gin.Context) {
+	job := c.MustGet(jobKey).(*uploadJob)
+	static, err := job.previewStatic()
+	if err != nil {
+		logFor(c.Request.Context()).Error("could not prepare preview static files", "job", job.ID, "error", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "could not prepare static files: " + err.Error()})
+		return
+	}
+	static(c)
+}
+
+// uploadHandler receives a zip file in the form field "resources" and starts an upload job for it
+func uploadHandler(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadSize)
+	file, err := c.FormFile("resources")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing zip file in form field resources: " + err.Error()})
+		return
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create job: " + err.Error()})
+		return
+	}
+	dir := filepath.Join(cfg.Paths.Staging, id)
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &uploadJob{
+		jobStatus: jobStatus{ID: id, Status: jobRunning, Created: time.Now()},
+		database:  stagingPrefix() + id,
+		dir:       dir,
+		subs:      make(map[chan jobEvent]struct{}),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		images:    overlayFS{os.DirFS(filepath.Join(dir, "static")), os.DirFS(cfg.Paths.Static)},
+	}
+	err = os.MkdirAll(job.dir, os.ModePerm)
+	if err == nil {
+		err = c.SaveUploadedFile(file, filepath.Join(job.dir, "resources.zip"))
+	}
+	if err != nil {
+		cancel()
+		if err := os.RemoveAll(job.dir); err != nil {
+			appLog.Warn("could not remove staging folder", "error", err)
+		}
+		logFor(c.Request.Context()).Error("could not save upload", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save upload: " + err.Error()})
+		return
+	}
+
+	jobsMux.Lock()
+	jobs[id] = job
+	jobsMux.Unlock()
+	logFor(c.Request.Context()).Info("upload job started", "job", id, "file", file.Filename, "bytes", file.Size)
+	go job.run(ctx)
+
+	base := basePath() + "/admin"
+	c.Header("Location", base+"/jobs/"+id)
+	c.JSON(http.StatusAccepted, gin.H{
+		"id":      id,
+		"status":  base + "/jobs/" + id,
+		"events":  base + "/jobs/" + id + "/events",
+		"preview": base + "/preview/" + id + "/",
+		"publish": base + "/jobs/" + id + "/publish",
+	})
+}
+
+// jobsHandler lists all upload jobs
+func jobsHandler(c *gin.Context) {
+	jobsMux.Lock()
+	list := make([]jobStatus, 0, len(jobs))
+	for _, job := range jobs {
+		list = append(list, job.status())
+	}
+	jobsMux.Unlock()
+	c.JSON(http.StatusOK, list)
+}
+
+// jobHandler returns the state of an upload job
+func jobHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, c.MustGet(jobKey).(*uploadJob).status())
+}
+
+// jobEventsHandler streams the progress of an upload job as server-sent events until the job is finished
+func jobEventsHandler(c *gin.Context) {
+	job := c.MustGet(jobKey).(*uploadJob)
+	past, ch := job.subscribe()
+	defer job.unsubscribe(ch)
+
+	for _, event := range past {
+		c.SSEvent(event.Step, event)
+	}
+	c.Writer.Flush()
+	if ch == nil {
+		return
+	}
+	end := streamEnd()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return false
+			}
+			c.SSEvent(event.Step, event)
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		case <-end:
+			return false
+		case <-stopping:
+			return false
+		}
+	})
+}
+
+// publishHandler publishes the data of a ready upload job to the live server
+func publishHandler(c *gin.Context) {
+	job := c.MustGet(jobKey).(*uploadJob)
+	publishMux.Lock()
+	defer publishMux.Unlock()
+	if status := job.status(); status.Status != jobReady {
+		c.JSON(http.StatusConflict, gin.H{"error": "only ready jobs can be published", "job": status})
+		return
+	}
+	err := job.publish()
+	if err != nil {
+		logFor(c.Request.Context()).Error("could not publish job", "job", job.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not publish job: " + err.Error()})
+		return
+	}
+	// the other ready jobs were uploaded for the data that is replaced now
+	jobsMux.Lock()
+	var others []*uploadJob
+	for _, other := range jobs {
+		if other != job && other.status().Status == jobReady {
+			others = append(others, other)
+		}
+	}
+	jobsMux.Unlock()
+	for _, other := range others {
+		other.discard("discarded because job " + job.ID + " was published")
+	}
+	c.JSON(http.StatusOK, job.status())
+}
+
+// deleteJobHandler cancels a running job, discards a ready job and forgets the job
+func deleteJobHandler(c *gin.Context) {
+	job := c.MustGet(jobKey).(*uploadJob)
+	if job.status().Status == jobRunning {
+		job.cancel()
+		select {
+		case <-job.done:
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+	publishMux.Lock()
+	defer publishMux.Unlock()
+	if job.status().Status == jobReady {
+		job.discard("discarded on request")
+	}
+	jobsMux.Lock()
+	delete(jobs, job.ID)
+	jobsMux.Unlock()
+	logFor(c.Request.Context()).Info("upload job deleted", "job", job.ID)
+	c.Status(http.StatusNoContent)
+}
+
+// expireJobs forgets the jobs that finished longer than the job TTL ago until the server stops,
+// ready jobs are discarded so their staging database and folder do not stay around
+func expireJobs() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopping:
+			return
+		}
+		publishMux.Lock()
+		jobsMux.Lock()
+		var expired []*uploadJob
+		for id, job := range jobs {
+			if job.expired(cfg.Admin.JobTTL) {
+				expired = append(expired, job)
+				delete(jobs, id)
+			}
+		}
+		jobsMux.Unlock()
+		for _, job := range expired {
+			if job.status().Status == jobReady {
+				job.discard("discarded because it expired")
+			}
+			appLog.Info("upload job expired", "job", job.ID)
+		}
+		publishMux.Unlock()
+	}
+}
+
+// jobDatabase reports if the database with the given name is the staging database of a current job
+func jobDatabase(name string) bool {
+	jobsMux.Lock()
+	defer jobsMux.Unlock()
+	for _, job := range jobs {
+		if job.database == name {
+			return true
+		}
+	}
+	return false
+}
+
+// newJobID returns a random id for an upload job
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// run extracts the zip file of the job and imports it into the staging database
+// it stops when the job is deleted or the server shuts down
+func (j *uploadJob) run(ctx context.Context) {
+	defer close(j.done)
+	defer j.cancel()
+	go func() {
+		select {
+		case <-stopping:
+			j.cancel()
+		case <-ctx.Done():
+		}
+	}()
+	j.report("upload", "zip file received", 10)
+
+	jsonOut := filepath.Join(j.dir, "json")
+	err := extractZip(ctx, filepath.Join(j.dir, "resources.zip"), jsonOut, filepath.Join(j.dir, "static"))
+	if err != nil {
+		j.fail(fmt.Errorf("could not extract zip file: %w", err))
+		return
+	}
+	j.report("extract", "zip file extracted", 30)
+
+	imported := 0
+	err = importJSON(withDatabase(ctx, j.database), jsonOut, func(collection string, count int) {
+		imported++
+		j.report("import", fmt.Sprintf("inserted %d entries to %s", count, collection), 30+60*imported/len(collections))
+	})
+	if err != nil {
+		dropDatabase(j.database)
+		j.fail(err)
+		return
+	}
+	j.finish(jobReady, "import finished, the job can be previewed and published")
+}
+
+// publish switches the live database to the staging database and keeps the uploaded files for the next import
+// the zip and json files are copied next to their targets first and only replace them once the database is switched,
+// so a failed publish leaves the live files as they are
+func (j *uploadJob) publish() error {
+	staged, err := j.stageFiles()
+	if err != nil {
+		removeStagedFiles(staged)
+		return err
+	}
+	err = switchLiveDatabase(j.database)
+	if err != nil {
+		removeStagedFiles(staged)
+		return err
+	}
+	appLog.Info("published job", "job", j.ID)
+
+	// the data is live now, files that cannot be kept are only missing for the next import
+	for tmp, target := range staged {
+		err = os.Rename(tmp, target)
+		if err != nil {
+			break
+		}
+	}
+	if _, statErr := os.Stat(filepath.Join(j.dir, "static")); err == nil && statErr == nil {
+		err = copyDir(filepath.Join(j.dir, "static"), cfg.Paths.Static)
+	}
+	if err != nil {
+		removeStagedFiles(staged)
+		appLog.Error("could not keep the files of the published job", "job", j.ID, "error", err)
+		j.report(jobPublished, "could not keep the uploaded files for the next import: "+err.Error(), 100)
+	}
+	j.report(jobPublished, "job published to the live server", 100)
+	j.mu.Lock()
+	j.Status = jobPublished
+	j.finished = time.Now()
+	j.mu.Unlock()
+
+	err = os.RemoveAll(j.dir)
+	if err != nil {
+		appLog.Warn("could not remove staging folder", "error", err)
+	}
+	return nil
+}
+
+// stageFiles copies the zip file and the json files of the job next to the files they replace
+// it returns the copies mapped to their targets, also the ones that were copied before an error
+func (j *uploadJob) stageFiles() (map[string]string, error) {
+	staged := make(map[string]string)
+	copyTo := func(src string, target string) error {
+		tmp := target + ".tmp"
+		staged[tmp] = target
+		return copyFile(src, tmp)
+	}
+	err := copyTo(filepath.Join(j.dir, "resources.zip"), filepath.Join(cfg.Paths.Input, cfg.Paths.Zip))
+	if err != nil {
+		return staged, err
+	}
+	err = os.MkdirAll(cfg.Paths.JSON, os.ModePerm)
+	if err != nil {
+		return staged, err
+	}
+	files, err := os.ReadDir(filepath.Join(j.dir, "json"))
+	if err != nil {
+		return staged, err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		err = copyTo(filepath.Join(j.dir, "json", f.Name()), filepath.Join(cfg.Paths.JSON, f.Name()))
+		if err != nil {
+			return staged, err
+		}
+	}
+	return staged, nil
+}
+
+// removeStagedFiles removes the copies returned by stageFiles that were not moved to their targets
+func removeStagedFiles(staged map[string]string) {
+	for tmp := range staged {
+		if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+			appLog.Warn("could not remove staged file", "file", tmp, "error", err)
+		}
+	}
+}
+
+// previewStatic returns the handler of the static files of the preview, it is created on the first request
+func (j *uploadJob) previewStatic() (gin.HandlerFunc, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.static == nil {
+		static, err := staticFS()
+		if err != nil {
+			return nil, err
+		}
+		staged := imagesFS{os.DirFS(filepath.Join(j.dir, "static"))}
+		j.static = assetHandler(overlayFS{staged, static})
+	}
+	return j.static, nil
+}
+
+// previewTemplates returns the templates of the preview, their url function links to the pages and images of the preview
+func (j *uploadJob) previewTemplates() (*template.Template, error) {
+	live := getTemplates()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.templates != nil && j.liveTemplates == live {
+		return j.templates, nil
+	}
+	root := basePath() + "/admin/preview/" + j.ID
+	funcs := templateFuncs()
+	funcs["url"] = func(parts ...interface{}) string { return joinURL(root, parts...) }
+	tmpl, err := parseTemplatesWith(funcs)
+	if err != nil {
+		return nil, err
+	}
+	j.templates, j.liveTemplates = tmpl, live
+	return tmpl, nil
+}
+
+// discard drops the staging database and removes the folder of a ready job, it can no longer be previewed or published
+func (j *uploadJob) discard(message string) {
+	dropDatabase(j.database)
+	err := os.RemoveAll(j.dir)
+	if err != nil {
+		appLog.Warn("could not remove staging folder", "error", err)
+	}
+	appLog.Info("upload job discarded", "job", j.ID, "reason", message)
+	j.finish(jobDiscarded, message)
+}
+
+// expired reports if the job finished longer than ttl ago
+func (j *uploadJob) expired(ttl time.Duration) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Status != jobRunning && time.Since(j.finished) > ttl
+}
+
+// report adds a progress event to the job and sends it to all subscribers
+func (j *uploadJob) report(step string, message string, progress int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	event := jobEvent{Step: step, Message: message, Progress: progress, Time: time.Now()}
+	j.Events = append(j.Events, event)
+	j.Progress = progress
+	for ch := range j.subs {
+		select {
+		case ch <- event:
+		default:
+			// the subscriber is too slow, it still gets the full list from the job status
+		}
+	}
+}
+
+// fail finishes the job with an error
+func (j *uploadJob) fail(err error) {
+	appLog.Error("upload job failed", "job", j.ID, "error", err)
+	j.mu.Lock()
+	j.Error = err.Error()
+	j.mu.Unlock()
+	j.finish(jobFailed, err.Error())
+	err = os.RemoveAll(j.dir)
+	if err != nil {
+		appLog.Warn("could not remove staging folder", "error", err)
+	}
+}
+
+// finish sets the final state of the extraction and import and closes all event streams
+func (j *uploadJob) finish(status string, message string) {
+	progress := 100
+	if status == jobFailed {
+		progress = j.status().Progress
+	}
+	j.report(status, message, progress)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Status = status
+	j.finished = time.Now()
+	for ch := range j.subs {
+		close(ch)
+		delete(j.subs, ch)
+	}
+}
+
+// subscribe returns all events so far and a channel for the following events
+// the channel is nil if the job is not running anymore
+func (j *uploadJob) subscribe() ([]jobEvent, chan jobEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	past := append([]jobEvent(nil), j.Events...)
+	if j.Status != jobRunning {
+		return past, nil
+	}
+	ch := make(chan jobEvent, 16)
+	j.subs[ch] = struct{}{}
+	return past, ch
+}
+
+// unsubscribe removes a channel returned by subscribe
+func (j *uploadJob) unsubscribe(ch chan jobEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.subs, ch)
+}
+
+// status returns a copy of the public state of the job
+func (j *uploadJob) status() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := j.jobStatus
+	status.Events = append([]jobEvent(nil), j.Events...)
+	return status
+}
@@ -0,0 +1,173 @@
+/*
+ This file contains the manifest and the archives of the static build.
+ The manifest lists every file of the build with its size and SHA-256 and the hash of the whole build,
+ the archives contain the same files in the same order with fixed times and modes,
+ so the same data, templates and static files always give the same bytes and the same archive name.
+*/
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// manifestName is the file of the manifest in the buildDir
+const manifestName = "manifest.json"
+
+// buildManifest is the content of the manifest
+type buildManifest struct {
+	// SHA256 is the hash of the paths and hashes of all files, it names the archives
+	SHA256 string          `json:"sha256"`
+	Files  []manifestEntry `json:"files"`
+}
+
+// manifestEntry is a file of the build in the manifest
+type manifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// newManifest returns the manifest of the files of a build cache sorted by path
+func newManifest(cache buildCache) buildManifest {
+	manifest := buildManifest{Files: make([]manifestEntry, 0, len(cache.Files))}
+	for name, entry := range cache.Files {
+		manifest.Files = append(manifest.Files, manifestEntry{Path: name, Size: entry.Size, SHA256: entry.SHA256})
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Path < manifest.Files[j].Path })
+	h := sha256.New()
+	for _, file := range manifest.Files {
+		// the same lines as sha256sum prints
+		fmt.Fprintf(h, "%s  %s\n", file.SHA256, file.Path)
+	}
+	manifest.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return manifest
+}
+
+// writeManifest writes the manifest to the buildDir
+func writeManifest(manifest buildManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(buildDir(), manifestName), append(data, '\n'), 0644)
+}
+
+// archiveTime returns the modification time of the files in the archives
+func archiveTime() time.Time {
+	if cfg.Build.SourceDateEpoch > 0 {
+		return time.Unix(int64(cfg.Build.SourceDateEpoch), 0).UTC()
+	}
+	// the earliest time a zip file can hold
+	return time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// writeArchive packages the files of the manifest and the manifest itself as cfg.Build.Archive in the output folder
+// the archive is named with the hash of the manifest, an existing archive with the same name is kept
+// a file that no longer has the hash of the manifest fails the archive
+func writeArchive(manifest buildManifest) (string, error) {
+	name := filepath.Join(cfg.Paths.Output, "webapp_build-"+manifest.SHA256[:16]+"."+cfg.Build.Archive)
+	if _, err := os.Stat(name); err == nil {
+		return name, nil
+	}
+	tmp := name + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+	if cfg.Build.Archive == "zip" {
+		err = writeZip(out, manifest)
+	} else {
+		err = writeTarGz(out, manifest)
+	}
+	closeErr := out.Close()
+	if err != nil {
+		return "", err
+	}
+	if closeErr != nil {
+		return "", closeErr
+	}
+	return name, os.Rename(tmp, name)
+}
+
+// archiveFiles calls add for every file of the manifest and the manifest itself with its content in the buildDir
+func archiveFiles(manifest buildManifest, add func(name string, content []byte) error) error {
+	for _, file := range manifest.Files {
+		content, err := os.ReadFile(filepath.Join(buildDir(), filepath.FromSlash(file.Path)))
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		if hex.EncodeToString(sum[:]) != file.SHA256 {
+			return fmt.Errorf("%s was changed after the build", file.Path)
+		}
+		err = add(file.Path, content)
+		if err != nil {
+			return err
+		}
+	}
+	content, err := os.ReadFile(filepath.Join(buildDir(), manifestName))
+	if err != nil {
+		return err
+	}
+	return add(manifestName, content)
+}
+
+// writeZip writes the files of the manifest as zip file
+func writeZip(w io.Writer, manifest buildManifest) error {
+	zw := zip.NewWriter(w)
+	err := archiveFiles(manifest, func(name string, content []byte) error {
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: archiveTime()}
+		header.SetMode(0644)
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		_, err = fw.Write(content)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// writeTarGz writes the files of the manifest as gzip compressed tar file
+func writeTarGz(w io.Writer, manifest buildManifest) error {
+	// the gzip header has no name and no time
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err := archiveFiles(manifest, func(name string, content []byte) error {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Size:     int64(len(content)),
+			Mode:     0644,
+			ModTime:  archiveTime(),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(content)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gw.Close()
+}
@@ -0,0 +1,205 @@
+/*
+ This file contains the templates, static assets and themes, they are embedded into the binary.
+ An override folder set in paths.assets can contain a templates, static and themes folder,
+ its files shadow the embedded ones with the same path.
+ The webserver and the static build both load all templates and assets from here.
+*/
+package main
+
+import (
+	"embed"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const templatePattern = "templates/*/*.templ.html" // pattern of all templates in the assets
+
+//go:embed templates static themes
+var embedded embed.FS
+
+// assetsOverride returns the folder whose files shadow the embedded assets or "" if there is none
+// in watch mode it defaults to the working directory, so changes to the templates and static files are used
+func assetsOverride() string {
+	dir := cfg.Paths.Assets
+	if dir == "" && cfg.Watch {
+		dir = "."
+	}
+	return dir
+}
+
+// assets returns the file system with the templates and static assets
+func assets() fs.FS {
+	if dir := assetsOverride(); dir != "" {
+		return overlayFS{os.DirFS(dir), embedded}
+	}
+	return embedded
+}
+
+// staticFS returns the file system of the static folder of the selected theme
+// together with the images extracted from the zip file to the static folder
+func staticFS() (fs.FS, error) {
+	static, err := themeStaticFS(assets())
+	if err != nil {
+		return nil, err
+	}
+	return overlayFS{imagesFS{os.DirFS(cfg.Paths.Static)}, static}, nil
+}
+
+// imagesFS is the images folder of a file system, all other files are hidden
+// so the static folder on disk does not shadow the static files of the theme
+type imagesFS struct {
+	fs.FS
+}
+
+// Open opens a file of the images folder
+func (f imagesFS) Open(name string) (fs.File, error) {
+	if !isImagePath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return f.FS.Open(name)
+}
+
+// ReadDir returns the entries of a directory in the images folder, the root only contains the images folder
+func (f imagesFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name != "." {
+		if !isImagePath(name) {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+		}
+		return fs.ReadDir(f.FS, name)
+	}
+	entries, err := fs.ReadDir(f.FS, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Name() == "images" {
+			return []fs.DirEntry{entry}, nil
+		}
+	}
+	return nil, nil
+}
+
+// isImagePath reports if the path is the images folder or in it
+func isImagePath(name string) bool {
+	return name == "images" || strings.HasPrefix(name, "images/")
+}
+
+// overlayFS is a file system of layers, a file is opened from the first layer that has it
+// and the entries of a directory are merged from all layers
+type overlayFS []fs.FS
+
+// Open opens the file from the first layer that has it
+func (o overlayFS) Open(name string) (fs.File, error) {
+	for _, layer := range o {
+		f, err := layer.Open(name)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// ReadDir returns the entries of the directory from all layers sorted by name
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	seen := make(map[string]bool)
+	found := false
+	for _, layer := range o {
+		list, err := fs.ReadDir(layer, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		for _, entry := range list {
+			if !seen[entry.Name()] {
+				seen[entry.Name()] = true
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if !found {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// filesOnly is a http.FileSystem that does not list directories
+type filesOnly struct {
+	http.FileSystem
+}
+
+// Open opens a file without its directory listing
+func (f filesOnly) Open(name string) (http.File, error) {
+	file, err := f.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return noReaddirFile{file}, nil
+}
+
+// noReaddirFile is a http.File that returns no directory entries
+type noReaddirFile struct {
+	http.File
+}
+
+// Readdir returns no entries
+func (noReaddirFile) Readdir(int) ([]fs.FileInfo, error) {
+	return nil, nil
+}
+
+// copyFS copies all files of a file system to the dst directory
+func copyFS(fsys fs.FS, dst string) error {
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, filepath.FromSlash(name))
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		// Skip symlinks.
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		return copyFSFile(fsys, name, target)
+	})
+}
+
+// copyFSFile copies a single file of a file system to dst
+func copyFSFile(fsys fs.FS, name string, dst string) error {
+	in, err := fsys.Open(path.Clean(name))
+	if err != nil {
+		return err
+	}
+	defer func(in fs.File) {
+		err := in.Close()
+		if err != nil {
+			return
+		}
+	}(in)
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
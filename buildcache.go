@@ -0,0 +1,222 @@
+/*
+ This file contains the cache of the static build.
+ It records for every file of the build the hash of its inputs and the size and hash of its content,
+ so the next build only writes the files whose data, templates or assets changed.
+ The cache is saved next to the build folder, deleting it makes the next build write every file again.
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// buildCache is the content of the cache file
+type buildCache struct {
+	Files map[string]buildEntry `json:"files"`
+}
+
+// buildEntry is a file of the last build
+type buildEntry struct {
+	Input  string `json:"input"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// buildChanges are the files of a build sorted by what happens to them
+type buildChanges struct {
+	added     []buildFile
+	changed   []buildFile
+	unchanged []buildFile
+	// deleted are the paths of files in the build folder that are not part of the build anymore
+	deleted []string
+}
+
+// buildCachePath returns the file of the build cache in the output folder
+func buildCachePath() string {
+	return filepath.Join(cfg.Paths.Output, "build-cache.json")
+}
+
+// loadBuildCache reads the build cache, a missing or unreadable cache is empty
+func loadBuildCache() buildCache {
+	cache := buildCache{Files: make(map[string]buildEntry)}
+	data, err := os.ReadFile(buildCachePath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return cache
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &cache)
+	}
+	if err != nil || cache.Files == nil {
+		appLog.Warn("could not read build cache, all files are written", "file", buildCachePath(), "error", err)
+		return buildCache{Files: make(map[string]buildEntry)}
+	}
+	return cache
+}
+
+// saveBuildCache writes the build cache, it is replaced in one step so it is never half written
+func saveBuildCache(cache buildCache) error {
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(cfg.Paths.Output, 0755)
+	if err != nil {
+		return err
+	}
+	tmp := buildCachePath() + ".tmp"
+	err = os.WriteFile(tmp, append(data, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, buildCachePath())
+}
+
+// diffBuild compares the planned files with the cache and the build folder
+// a file is unchanged if its input hash is the cached one and the file in the build folder still has the cached content,
+// so a file that was edited or damaged in the build folder is written again
+func diffBuild(cache buildCache, files []buildFile) (buildChanges, error) {
+	var changes buildChanges
+	planned := make(map[string]bool, len(files))
+	build := os.DirFS(buildDir())
+	for _, file := range files {
+		planned[file.path] = true
+		info, err := os.Stat(filepath.Join(buildDir(), filepath.FromSlash(file.path)))
+		if err != nil {
+			changes.added = append(changes.added, file)
+			continue
+		}
+		entry, ok := cache.Files[file.path]
+		same := ok && file.input != "" && entry.Input == file.input && entry.Size == info.Size()
+		if same {
+			// the size is checked first, only files that may be unchanged are read
+			hash, err := hashFile(build, file.path)
+			same = err == nil && hash == entry.SHA256
+		}
+		if same {
+			changes.unchanged = append(changes.unchanged, file)
+		} else {
+			changes.changed = append(changes.changed, file)
+		}
+	}
+	err := filepath.WalkDir(buildDir(), func(name string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && name == buildDir() {
+			return filepath.SkipDir
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(buildDir(), name)
+		if err != nil {
+			return err
+		}
+		// the manifest is written after every build
+		if !planned[filepath.ToSlash(rel)] && rel != manifestName {
+			changes.deleted = append(changes.deleted, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return buildChanges{}, fmt.Errorf("error reading build folder: %w", err)
+	}
+	return changes, nil
+}
+
+// print lists the added, changed and deleted files sorted by path and the number of unchanged ones
+func (c buildChanges) print(w io.Writer) {
+	type line struct{ action, path string }
+	var lines []line
+	for _, file := range c.added {
+		lines = append(lines, line{"add", file.path})
+	}
+	for _, file := range c.changed {
+		lines = append(lines, line{"change", file.path})
+	}
+	for _, name := range c.deleted {
+		lines = append(lines, line{"delete", name})
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].path < lines[j].path })
+	for _, l := range lines {
+		fmt.Fprintf(w, "%-7s %s\n", l.action, l.path)
+	}
+	fmt.Fprintf(w, "%d added, %d changed, %d unchanged, %d deleted\n", len(c.added), len(c.changed), len(c.unchanged), len(c.deleted))
+}
+
+// removeStale removes the files of earlier builds and the folders that are empty afterwards
+func removeStale(names []string) error {
+	dirs := make(map[string]bool)
+	for _, name := range names {
+		appLog.Debug("removing stale file", "path", name)
+		err := os.Remove(filepath.Join(buildDir(), filepath.FromSlash(name)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	list := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		list = append(list, dir)
+	}
+	// the deepest folders first, so their parents can be empty afterwards
+	sort.Sort(sort.Reverse(sort.StringSlice(list)))
+	for _, dir := range list {
+		entries, err := os.ReadDir(filepath.Join(buildDir(), filepath.FromSlash(dir)))
+		if err == nil && len(entries) == 0 {
+			_ = os.Remove(filepath.Join(buildDir(), filepath.FromSlash(dir)))
+		}
+	}
+	return nil
+}
+
+// hashFile returns the SHA-256 of a file of a file system
+func hashFile(fsys fs.FS, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashTemplates returns a hash of the template files parseTemplates reads and the version of the application,
+// so a changed template or a new version renders every page again
+func hashTemplates() (string, error) {
+	fsys := assets()
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00", version)
+	patterns := []string{templatePattern}
+	for _, dir := range themeDirs() {
+		patterns = append(patterns, path.Join(dir, templatePattern))
+	}
+	for _, pattern := range patterns {
+		matches, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			return "", err
+		}
+		for _, name := range matches {
+			data, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(h, "%s\x00%d\x00", name, len(data))
+			h.Write(data)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,214 @@
+/*
+ This file contains the in-memory caches of the web server.
+ The query cache keeps the data of the pages, the page cache keeps the rendered pages with their ETag.
+ Both are keyed by the database, so previews of upload jobs never mix with the live pages,
+ the page cache also by the path of the request.
+ The least recently used entries are evicted when a cache is full and both caches are cleared
+ whenever an import or a publish changes the data.
+*/
+package main
+
+import (
+	"container/list"
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sync"
+)
+
+// maxQueryEntries is the number of query results the query cache keeps
+const maxQueryEntries = 1024
+
+var (
+	pageCache  = newCache("pages")
+	queryCache = newCache("queries")
+)
+
+// lruCache is a cache that evicts the least recently used entries when their total size is over its limit
+type lruCache struct {
+	name  string
+	mu    sync.Mutex
+	limit int
+	size  int
+	// generation changes whenever the cache is cleared, results loaded before are not added anymore
+	generation uint64
+	order      *list.List
+	entries    map[string]*list.Element
+}
+
+// cacheEntry is an entry of a cache with its size
+type cacheEntry struct {
+	key   string
+	value interface{}
+	size  int
+}
+
+// cachedPage is a rendered page of the page cache
+type cachedPage struct {
+	status int
+	body   []byte
+	etag   string
+	// variants are the compressed bodies, nil in watch mode where the live-reload script is added to the body
+	variants compressedVariants
+}
+
+// newCache returns an empty cache, it stays disabled until its limit is set
+func newCache(name string) *lruCache {
+	return &lruCache{name: name, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// setLimit sets the maximum total size of the entries, 0 disables the cache
+func (l *lruCache) setLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.evict()
+}
+
+// get returns the value of the key and marks it as recently used
+func (l *lruCache) get(key string) (interface{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit == 0 {
+		return nil, false
+	}
+	element, ok := l.entries[key]
+	if !ok {
+		cacheRequests.add(1, l.name, "miss")
+		return nil, false
+	}
+	cacheRequests.add(1, l.name, "hit")
+	l.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).value, true
+}
+
+// currentGeneration returns the generation to pass to add for a value that is loaded now
+func (l *lruCache) currentGeneration() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.generation
+}
+
+// add adds a value loaded in the given generation, values that are larger than the whole cache
+// or that were loaded before the cache was cleared are not added
+func (l *lruCache) add(key string, value interface{}, size int, generation uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if size > l.limit || generation != l.generation {
+		return
+	}
+	if element, ok := l.entries[key]; ok {
+		l.size -= element.Value.(*cacheEntry).size
+		l.order.Remove(element)
+	}
+	l.entries[key] = l.order.PushFront(&cacheEntry{key: key, value: value, size: size})
+	l.size += size
+	l.evict()
+}
+
+// evict removes the least recently used entries until the cache fits its limit
+func (l *lruCache) evict() {
+	for l.size > l.limit && l.order.Len() > 0 {
+		entry := l.order.Remove(l.order.Back()).(*cacheEntry)
+		delete(l.entries, entry.key)
+		l.size -= entry.size
+	}
+	cacheSize.set(float64(l.size), l.name)
+	cacheEntries.set(float64(len(l.entries)), l.name)
+}
+
+// clear removes all entries
+func (l *lruCache) clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.generation++
+	l.order.Init()
+	l.entries = make(map[string]*list.Element)
+	l.size = 0
+	l.evict()
+}
+
+// setupCaches sets the limits of the caches from the configuration
+func setupCaches() {
+	pageCache.setLimit(cfg.Cache.MaxSize << 20)
+	if cfg.Cache.MaxSize == 0 {
+		queryCache.setLimit(0)
+	} else {
+		queryCache.setLimit(maxQueryEntries)
+	}
+}
+
+// invalidateCaches clears the caches, it is called whenever the data or the templates change
+func invalidateCaches() {
+	pageCache.clear()
+	queryCache.clear()
+	markContentModified()
+}
+
+// cachedQuery returns the cached result of a query of the database of the context or loads and caches it
+func cachedQuery(ctx context.Context, key string, load func() (interface{}, error)) (interface{}, error) {
+	key = databaseName(ctx) + "\x00" + key
+	if value, ok := queryCache.get(key); ok {
+		return value, nil
+	}
+	generation := queryCache.currentGeneration()
+	value, err := load()
+	if err != nil {
+		return value, err
+	}
+	queryCache.add(key, value, 1, generation)
+	return value, nil
+}
+
+// servePage answers with the cached page of the request or loads its data, renders it and caches it
+// only pages with status 200 are cached, so missing products and errors never fill the cache
+func servePage(c *gin.Context, name string, load func(ctx context.Context) (int, interface{}, error)) {
+	ctx := dataContext(c)
+	key := databaseName(ctx) + "\x00" + c.Request.URL.Path
+	if page, ok := pageCache.get(key); ok {
+		sendPage(c, page.(*cachedPage))
+		return
+	}
+	generation := pageCache.currentGeneration()
+	status, data, err := load(ctx)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	body, err := renderTemplate(c, name, data)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	page := &cachedPage{status: status, body: body, etag: contentETag(body)}
+	if cfg.Server.Compress && !cfg.Watch {
+		page.variants = compressVariants("text/html", body, false)
+	}
+	if status == http.StatusOK {
+		size := len(body)
+		for _, variant := range page.variants {
+			size += len(variant)
+		}
+		pageCache.add(key, page, size, generation)
+	}
+	sendPage(c, page)
+}
+
+// sendPage sends a rendered page compressed as the request accepts with the cache headers of pages
+// a page that did not change since the If-None-Match or If-Modified-Since header of the request is answered with 304
+func sendPage(c *gin.Context, page *cachedPage) {
+	encoding, body := page.variants.pick(c, page.body)
+	if page.status == http.StatusOK {
+		etag := encodedETag(page.etag, encoding)
+		modified := getContentModified()
+		setCacheControl(c, cfg.Cache.HTML)
+		c.Header("ETag", etag)
+		c.Header("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		if notModified(c, etag, modified) {
+			c.Writer.Header().Del("Content-Encoding")
+			c.Status(http.StatusNotModified)
+			return
+		}
+	}
+	c.Data(page.status, "text/html; charset=utf-8", body)
+}
@@ -0,0 +1,260 @@
+/*
+ This file contains the command-line interface of the application.
+ Every step of main.go can run on its own as a command with its own flags,
+ all commands also accept the configuration flags of config.go.
+ The exit code is 0 on success, 1 if the command failed and 2 for invalid arguments or configuration.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+)
+
+// version is set at build time with -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+// command is a subcommand of the application
+type command struct {
+	name  string
+	usage string
+	// database is true if the command needs the database settings
+	database bool
+	// config is false for commands that do not load the configuration
+	config bool
+	// setup registers the flags of the command and returns the function that runs it
+	setup func(fs *flag.FlagSet) func() error
+}
+
+// commands lists all commands, the command without a name runs when no command is given
+var commands = []command{
+	{"", "import the zip file, then build the static pages or start the web server (default)", true, true, func(fs *flag.FlagSet) func() error {
+		return runAll
+	}},
+	{"serve", "start the web server with the data in the database", true, true, serveCommand},
+	{"build", "build the static pages from the data in the database", true, true, buildCommand},
+	{"import", "import the zip file into the database", true, true, importCommand},
+	{"export", "export the database and images as zip file", true, true, exportCommand},
+	{"check", "check the links of the static build or of a running server", false, true, checkCommand},
+	{"publish", "publish the last static build to the publish target", false, true, func(fs *flag.FlagSet) func() error {
+		return func() error {
+			return publishBuild(context.Background())
+		}
+	}},
+	{"validate", "check the configuration, theme and zip file without the database", false, true, validateCommand},
+	{"version", "print the version", false, false, func(fs *flag.FlagSet) func() error {
+		return printVersion
+	}},
+}
+
+// run runs the command of the arguments and returns the exit code
+func run(args []string) int {
+	name := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name = args[0]
+		args = args[1:]
+	}
+	if name == "help" {
+		printUsage()
+		return exitOK
+	}
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == name {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printUsage()
+		return exitUsage
+	}
+
+	fs := flag.NewFlagSet(strings.TrimSpace("GoPortfolio "+name), flag.ContinueOnError)
+	var loader *configLoader
+	if cmd.config {
+		loader = newConfigLoader(fs)
+		loader.requireDatabase = cmd.database
+	}
+	action := cmd.setup(fs)
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		return exitOK
+	}
+	if err != nil {
+		return exitUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		return exitUsage
+	}
+
+	if loader != nil {
+		c, err := loader.load()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+		if *loader.print {
+			loader.printConfig(c)
+			return exitOK
+		}
+		cfg = c
+		setLiveDatabase(cfg.Database.Name)
+		err = setupLogging()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+	}
+
+	err = action()
+	if err != nil {
+		appLog.Error("command failed", "command", name, "error", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// printUsage prints all commands
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: GoPortfolio [command] [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, cmd := range commands {
+		if cmd.name != "" {
+			fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.usage)
+		}
+	}
+	fmt.Fprintln(os.Stderr, "\nWithout a command the zip file is imported and then the static pages are built or the web server is started.")
+	fmt.Fprintln(os.Stderr, "Run GoPortfolio [command] -h for the flags of a command.")
+}
+
+// serveCommand starts the web server, optionally after importing the zip file
+func serveCommand(fs *flag.FlagSet) func() error {
+	doImport := fs.Bool("import", false, "import the zip file before starting the web server")
+	return func() error {
+		// the web server links to pages without the .html suffix
+		cfg.Static = false
+		if *doImport {
+			err := importZip(defaultZipPath())
+			if err != nil {
+				return err
+			}
+		}
+		return dynamic()
+	}
+}
+
+// buildCommand builds the static pages, optionally after importing the zip file
+func buildCommand(fs *flag.FlagSet) func() error {
+	doImport := fs.Bool("import", false, "import the zip file before building the static pages")
+	dryRun := fs.Bool("dry-run", false, "list the files that would be added, changed or deleted without writing them")
+	publish := fs.Bool("publish", false, "publish the static build to the publish target afterwards")
+	return func() error {
+		// the links of the static pages need the .html suffix
+		cfg.Static = true
+		if *doImport {
+			err := importZip(defaultZipPath())
+			if err != nil {
+				return err
+			}
+		}
+		if !*publish {
+			return build(*dryRun)
+		}
+		if *dryRun || cfg.Watch {
+			return fmt.Errorf("-publish cannot be used with -dry-run or in watch mode")
+		}
+		err := static(false)
+		if err != nil {
+			return err
+		}
+		return publishBuild(context.Background())
+	}
+}
+
+// importCommand imports a zip file into the database
+func importCommand(fs *flag.FlagSet) func() error {
+	zipPath := fs.String("file", "", "zip file to import (default the zip file in the input folder)")
+	return func() error {
+		path := *zipPath
+		if path == "" {
+			path = defaultZipPath()
+		}
+		return importZip(path)
+	}
+}
+
+// exportCommand exports the database and the images as zip file that can be imported again
+func exportCommand(fs *flag.FlagSet) func() error {
+	out := fs.String("o", "export.zip", "zip file to write")
+	return func() error {
+		return exportZip(*out)
+	}
+}
+
+// checkCommand checks the links of the static build or of a running server and fails if it finds problems
+func checkCommand(fs *flag.FlagSet) func() error {
+	serverURL := fs.String("url", "", "URL of a running server to check instead of the static build, e.g. http://localhost:8080/")
+	return func() error {
+		var report linkReport
+		var err error
+		if *serverURL != "" {
+			report, err = checkServer(context.Background(), *serverURL)
+		} else {
+			report, err = checkBuild(context.Background())
+		}
+		if err != nil {
+			return err
+		}
+		report.print(os.Stdout)
+		if len(report.problems) > 0 {
+			return fmt.Errorf("%w: %d problems", errLinksBroken, len(report.problems))
+		}
+		return nil
+	}
+}
+
+// validateCommand checks the configuration, the theme and the zip file
+func validateCommand(fs *flag.FlagSet) func() error {
+	zipPath := fs.String("file", "", "zip file to check (default the zip file in the input folder)")
+	return func() error {
+		// the configuration is already checked when the command runs
+		appLog.Info("configuration is valid")
+		err := loadTheme()
+		if err != nil {
+			return err
+		}
+		path := *zipPath
+		if path == "" {
+			path = defaultZipPath()
+		}
+		return validateZip(path)
+	}
+}
+
+// printVersion prints the version and the commit the binary was built from
+func printVersion() error {
+	revision := ""
+	goVersion := ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		goVersion = info.GoVersion
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				revision = " " + s.Value
+			}
+		}
+	}
+	fmt.Printf("GoPortfolio %s%s (%s)\n", version, revision, goVersion)
+	return nil
+}
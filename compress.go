@@ -0,0 +1,316 @@
+/*
+ This file contains the compression of pages and static files.
+ The static build writes a .gz and a .br file next to every text file, so static web servers can send them as they are.
+ The web server keeps compressed variants of the prepared static files and the cached pages
+ and compresses other text responses on the fly, choosing brotli or gzip by the Accept-Encoding header of the request.
+ Answers to range requests and media like images are never compressed, so they can be requested in parts.
+*/
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// minCompressSize is the size below which responses are not compressed on the fly, the headers would outweigh the gain
+const minCompressSize = 1024
+
+// compressedTypes are the media types that are compressed besides text/*
+var compressedTypes = map[string]bool{
+	"application/javascript": true,
+	"application/json":       true,
+	"application/xml":        true,
+	"image/svg+xml":          true,
+}
+
+// compressedExt maps the encodings to the extension of their files in the static build
+var compressedExt = map[string]string{"br": ".br", "gzip": ".gz"}
+
+// compressedVariants are the brotli and gzip encoded variants of a response body, nil if it is not compressed
+type compressedVariants map[string][]byte
+
+// compressible reports if responses of a media type are compressed, event streams are never compressed
+func compressible(mediaType string) bool {
+	mediaType = strings.TrimSpace(strings.SplitN(mediaType, ";", 2)[0])
+	if mediaType == "text/event-stream" {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressedTypes[mediaType]
+}
+
+// compressibleFile reports if a file of the static build is compressed by its extension
+func compressibleFile(name string) bool {
+	return compressible(mime.TypeByExtension(path.Ext(name)))
+}
+
+// compressBytes returns the content encoded with brotli or gzip, best compresses as small as possible
+func compressBytes(encoding string, content []byte, best bool) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	if encoding == "br" {
+		level := brotli.DefaultCompression
+		if best {
+			level = brotli.BestCompression
+		}
+		w = brotli.NewWriterLevel(&buf, level)
+	} else {
+		level := gzip.DefaultCompression
+		if best {
+			level = gzip.BestCompression
+		}
+		// the gzip header has no name and no time, the same content gives the same bytes
+		w, _ = gzip.NewWriterLevel(&buf, level)
+	}
+	// writes to a buffer do not fail
+	_, _ = w.Write(content)
+	_ = w.Close()
+	return buf.Bytes()
+}
+
+// compressVariants returns the variants of a body of the media type that are smaller than the body itself
+func compressVariants(mediaType string, content []byte, best bool) compressedVariants {
+	if !compressible(mediaType) {
+		return nil
+	}
+	variants := make(compressedVariants)
+	for encoding := range compressedExt {
+		if encoded := compressBytes(encoding, content, best); len(encoded) < len(content) {
+			variants[encoding] = encoded
+		}
+	}
+	return variants
+}
+
+// acceptedEncoding returns the preferred encoding of the request out of br and gzip for which has returns true, "" for none
+// the encodings with q=0 are refused, brotli is preferred when both are accepted with the same quality
+func acceptedEncoding(r *http.Request, has func(encoding string) bool) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, _ = strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+			}
+		}
+		candidates := []string{name}
+		if name == "*" {
+			candidates = []string{"br", "gzip"}
+		}
+		for _, candidate := range candidates {
+			if _, ok := compressedExt[candidate]; !ok || q <= 0 || !has(candidate) {
+				continue
+			}
+			if q > bestQ || (q == bestQ && candidate == "br") {
+				best, bestQ = candidate, q
+			}
+		}
+	}
+	return best
+}
+
+// pick returns the variant the request accepts and sets the Content-Encoding and Vary headers for it
+// without a matching variant the encoding is "" and the body is the uncompressed one
+func (v compressedVariants) pick(c *gin.Context, body []byte) (string, []byte) {
+	if v == nil {
+		return "", body
+	}
+	addVary(c.Writer.Header())
+	encoding := acceptedEncoding(c.Request, func(encoding string) bool { return v[encoding] != nil })
+	if encoding == "" {
+		return "", body
+	}
+	c.Header("Content-Encoding", encoding)
+	return encoding, v[encoding]
+}
+
+// addVary adds Accept-Encoding to the Vary header if it is not there yet
+func addVary(header http.Header) {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	header.Add("Vary", "Accept-Encoding")
+}
+
+// compressedSiblings returns a .br and a .gz file for every text file of the build,
+// the content of a text file is made only once for the file and its siblings
+func compressedSiblings(files []buildFile) []buildFile {
+	var siblings []buildFile
+	for i := range files {
+		if !compressibleFile(files[i].path) {
+			continue
+		}
+		content := onceContent(files[i].content)
+		files[i].content = content
+		for encoding, ext := range compressedExt {
+			encoding := encoding
+			input := ""
+			if files[i].input != "" {
+				sum := sha256.Sum256([]byte(files[i].input + "\x00" + encoding))
+				input = hex.EncodeToString(sum[:])
+			}
+			siblings = append(siblings, buildFile{path: files[i].path + ext, input: input, content: func() ([]byte, error) {
+				data, err := content()
+				if err != nil {
+					return nil, err
+				}
+				return compressBytes(encoding, data, true), nil
+			}})
+		}
+	}
+	return siblings
+}
+
+// compressedSiblingPaths returns the files of the manifest that are the .br or .gz sibling of another file of it
+func compressedSiblingPaths(manifest buildManifest) map[string]bool {
+	paths := make(map[string]bool, len(manifest.Files))
+	for _, file := range manifest.Files {
+		paths[file.Path] = true
+	}
+	siblings := make(map[string]bool)
+	for _, file := range manifest.Files {
+		for _, ext := range compressedExt {
+			original := strings.TrimSuffix(file.Path, ext)
+			if original != file.Path && paths[original] && compressibleFile(original) {
+				siblings[file.Path] = true
+			}
+		}
+	}
+	return siblings
+}
+
+// onceContent returns a content function that makes the content only on its first call
+func onceContent(content func() ([]byte, error)) func() ([]byte, error) {
+	var (
+		once sync.Once
+		data []byte
+		err  error
+	)
+	return func() ([]byte, error) {
+		once.Do(func() { data, err = content() })
+		return data, err
+	}
+}
+
+// compressResponses is a middleware that compresses text responses of at least minCompressSize bytes on the fly
+// responses that already have a Content-Encoding, answers to range requests and HEAD requests are passed through
+func compressResponses(c *gin.Context) {
+	if !cfg.Server.Compress || c.Request.Method == http.MethodHead || c.GetHeader("Range") != "" {
+		c.Next()
+		return
+	}
+	writer := &compressWriter{ResponseWriter: c.Writer, request: c.Request}
+	c.Writer = writer
+	defer func() {
+		c.Writer = writer.ResponseWriter
+		writer.close()
+	}()
+	c.Next()
+}
+
+// compressWriter buffers the start of a response until it knows if the response is compressed
+type compressWriter struct {
+	gin.ResponseWriter
+	request *http.Request
+	buf     []byte
+	decided bool
+	// encoder is nil if the response is passed through
+	encoder io.WriteCloser
+}
+
+// Write buffers the body until minCompressSize bytes, then writes it compressed or as it is
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < minCompressSize {
+			return len(b), nil
+		}
+		err := w.decide(true)
+		return len(b), err
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// WriteString writes the body like Write
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush writes the buffered body and flushes the encoder, a response flushed before minCompressSize bytes is not compressed
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		_ = w.decide(false)
+	}
+	if f, ok := w.encoder.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// decide chooses the encoding of the response by its headers and the request and writes the buffered body
+func (w *compressWriter) decide(large bool) error {
+	w.decided = true
+	header := w.Header()
+	status := w.Status()
+	if compressible(header.Get("Content-Type")) && header.Get("Content-Encoding") == "" {
+		addVary(header)
+		encoding := acceptedEncoding(w.request, func(string) bool { return true })
+		if large && encoding != "" && status != http.StatusPartialContent && header.Get("Content-Range") == "" {
+			header.Set("Content-Encoding", encoding)
+			header.Del("Content-Length")
+			// a strong ETag is no longer valid for the compressed body
+			if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				header.Set("ETag", "W/"+etag)
+			}
+			if encoding == "br" {
+				w.encoder = brotli.NewWriterLevel(w.ResponseWriter, brotli.DefaultCompression)
+			} else {
+				w.encoder, _ = gzip.NewWriterLevel(w.ResponseWriter, gzip.DefaultCompression)
+			}
+		}
+	}
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if w.encoder != nil {
+		_, err := w.encoder.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+// close writes what is still buffered and finishes the compressed body
+func (w *compressWriter) close() {
+	if !w.decided {
+		_ = w.decide(false)
+	}
+	if w.encoder != nil {
+		err := w.encoder.Close()
+		if err != nil {
+			appLog.Warn("could not write response", "error", err)
+		}
+	}
+}
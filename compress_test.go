@@ -0,0 +1,124 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	all := func(string) bool { return true }
+	gzipOnly := func(encoding string) bool { return encoding == "gzip" }
+	tests := []struct {
+		header string
+		has    func(string) bool
+		want   string
+	}{
+		{"", all, ""},
+		{"identity", all, ""},
+		{"gzip", all, "gzip"},
+		{"br", all, "br"},
+		{"gzip, deflate, br", all, "br"},
+		{"GZIP", all, "gzip"},
+		{"gzip;q=1.0, br;q=0.5", all, "gzip"},
+		{"gzip;q=0.5, br;q=0.8", all, "br"},
+		{"gzip; q=0.9, br ; q=0.9", all, "br"},
+		{"br;q=0", all, ""},
+		{"gzip, br;q=0", all, "gzip"},
+		{"*", all, "br"},
+		{"*;q=0", all, ""},
+		{"*", gzipOnly, "gzip"},
+		{"br", gzipOnly, ""},
+		{"gzip;q=0.2, *;q=0.5", all, "br"},
+		{"gzip;q=invalid", all, ""},
+		{"deflate, compress", all, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", tt.header)
+		if got := acceptedEncoding(r, tt.has); got != tt.want {
+			t.Errorf("acceptedEncoding(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+// compressRouter returns a router with the compressResponses middleware that answers /page with size bytes of text and an ETag
+func compressRouter(size int) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(compressResponses)
+	router.Any("/page", func(c *gin.Context) {
+		c.Header("ETag", `"abc"`)
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(strings.Repeat("a", size)))
+	})
+	router.GET("/image", func(c *gin.Context) {
+		c.Data(http.StatusOK, "image/png", []byte(strings.Repeat("a", size)))
+	})
+	return router
+}
+
+func TestCompressResponses(t *testing.T) {
+	body := strings.Repeat("a", 2048)
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		size     int
+		headers  map[string]string
+		encoding string
+		etag     string
+	}{
+		{"gzip", http.MethodGet, "/page", 2048, map[string]string{"Accept-Encoding": "gzip"}, "gzip", `W/"abc"`},
+		{"brotli", http.MethodGet, "/page", 2048, map[string]string{"Accept-Encoding": "gzip, br"}, "br", `W/"abc"`},
+		{"not accepted", http.MethodGet, "/page", 2048, nil, "", `"abc"`},
+		{"refused", http.MethodGet, "/page", 2048, map[string]string{"Accept-Encoding": "gzip;q=0"}, "", `"abc"`},
+		{"small", http.MethodGet, "/page", minCompressSize - 1, map[string]string{"Accept-Encoding": "gzip"}, "", `"abc"`},
+		{"range", http.MethodGet, "/page", 2048, map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-9"}, "", `"abc"`},
+		{"head", http.MethodHead, "/page", 2048, map[string]string{"Accept-Encoding": "gzip"}, "", `"abc"`},
+		{"image", http.MethodGet, "/image", 2048, map[string]string{"Accept-Encoding": "gzip"}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			compressRouter(tt.size).ServeHTTP(w, r)
+			if got := w.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			if got := w.Header().Get("ETag"); got != tt.etag {
+				t.Errorf("ETag = %q, want %q", got, tt.etag)
+			}
+			var reader io.Reader = w.Body
+			switch tt.encoding {
+			case "gzip":
+				gz, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				reader = gz
+			case "br":
+				reader = brotli.NewReader(w.Body)
+			}
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the recorder keeps the body of HEAD requests, a server drops it
+			if string(got) != body[:tt.size] {
+				t.Errorf("body has %d bytes, want %d", len(got), tt.size)
+			}
+			if tt.encoding != "" && w.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", w.Header().Get("Vary"))
+			}
+		})
+	}
+}
@@ -0,0 +1,726 @@
+/*
+ This file contains the configuration of the application.
+ Every setting has a default value and is read from a YAML or TOML file, an environment variable
+ and a command-line flag, each overriding the ones before.
+ For every environment variable a variant with the suffix _FILE can name a file with the value,
+ which is used for secrets like Docker secrets.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/pelletier/go-toml/v2"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the configuration of the application
+type Config struct {
+	Static     bool
+	Watch      bool
+	Theme      string
+	BaseURL    string
+	PrettyURLs bool
+	Server     ServerConfig
+	Paths      PathConfig
+	Database   DatabaseConfig
+	Admin      AdminConfig
+	Log        LogConfig
+	Cache      CacheConfig
+	Build      BuildConfig
+	Publish    PublishConfig
+}
+
+// ServerConfig is the configuration of the webserver
+type ServerConfig struct {
+	Port              int
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	// WriteTimeout also limits event streams, they end before it and the browser reconnects
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	MaxHeaderBytes  int
+	ShutdownTimeout time.Duration
+	// HomeTimeout and PageTimeout are the deadlines of the database calls of the home page and of the other pages
+	HomeTimeout time.Duration
+	PageTimeout time.Duration
+	// Compress compresses text responses with brotli or gzip
+	Compress bool
+}
+
+// PathConfig contains the folders the application reads from and writes to
+type PathConfig struct {
+	Input   string
+	Zip     string
+	Output  string
+	JSON    string
+	Static  string
+	Assets  string
+	Staging string
+}
+
+// DatabaseConfig is the configuration of the database connection
+type DatabaseConfig struct {
+	// URI is a full connection string, it replaces Host and Port
+	URI string
+	// Host is a host name or a comma separated list of hosts of a replica set
+	Host       string
+	Port       int
+	User       string
+	Password   string
+	AuthSource string
+	Name       string
+	ReplicaSet string
+	// ReadPreference is primary, primaryPreferred, secondary, secondaryPreferred or nearest
+	ReadPreference  string
+	MaxPoolSize     int
+	MinPoolSize     int
+	MaxConnIdleTime time.Duration
+	TLS             bool
+	TLSCAFile       string
+	// TLSCertFile is the client certificate, TLSKeyFile may be empty if the key is in the same file
+	TLSCertFile string
+	TLSKeyFile  string
+	Timeout     time.Duration
+	// ConnectDeadline is how long connection attempts are retried before a command gives up
+	ConnectDeadline time.Duration
+}
+
+// AdminConfig is the configuration of the admin endpoints
+type AdminConfig struct {
+	Tokens string
+	// JobTTL is how long finished upload jobs are kept, the staging database of a ready job is dropped afterwards
+	JobTTL time.Duration
+}
+
+// LogConfig is the configuration of the logging
+type LogConfig struct {
+	Level  string
+	Format string
+	// AccessFile is the file of the access log in the Combined Log Format, empty to disable it
+	AccessFile string
+	// AccessMaxSize is the size in megabytes at which the access log is rotated
+	AccessMaxSize    int
+	AccessMaxBackups int
+}
+
+// CacheConfig is the configuration of the caches of the web server
+type CacheConfig struct {
+	// MaxSize is the size in megabytes of the rendered pages the page cache keeps, 0 disables the caches
+	MaxSize int
+	// HTML, Assets and Images are the Cache-Control headers of the pages and static files under their own names,
+	// the fingerprinted static files and the imported images, "" sends none
+	HTML   string
+	Assets string
+	Images string
+}
+
+// BuildConfig is the configuration of the static build
+type BuildConfig struct {
+	// Workers is the number of pages rendered at the same time, 0 for the number of CPUs
+	Workers int
+	// Minify minifies the pages, stylesheets, scripts and SVG files
+	Minify bool
+	// Fingerprint adds the hash of their content to the names of the static files
+	Fingerprint bool
+	// Compress writes a .gz and a .br file next to every text file
+	Compress bool
+	// Archive packages the build as zip or tar.gz named with its content hash, "" for no archive
+	Archive string
+	// Check checks the links of the build afterwards: off, warn logs the problems and fail also fails the build
+	Check string
+	// SourceDateEpoch is the modification time of the files in the archive in seconds since 1970, 0 for 1980-01-01
+	SourceDateEpoch int
+}
+
+// PublishConfig is the configuration of the publish step of the static build
+type PublishConfig struct {
+	// Target is where the build is published: dir, s3 or git
+	Target string
+	// Dir is the symlink that points to the published release, the releases are kept next to it
+	Dir string
+	// Keep is the number of earlier releases kept besides the published one
+	Keep int
+	// S3Endpoint is the URL of the S3-compatible server, the bucket is addressed in the path
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3Prefix    string
+	S3AccessKey string
+	S3SecretKey string
+	// GitRepo is the local repository and GitBranch the branch the build is committed to
+	GitRepo   string
+	GitBranch string
+}
+
+// setting describes one setting of the configuration and where it is read from
+type setting struct {
+	key    string // key in the configuration file, nested with dots
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	field  func(c *Config) interface{} // pointer to the field in the configuration
+}
+
+// cfg is the configuration of the application, it is loaded by main.go
+var cfg = defaultConfig()
+
+// settings lists all settings of the configuration
+var settings = []setting{
+	{"static", "BUILD_STATIC", "static", "build the static website instead of starting the webserver", false, func(c *Config) interface{} { return &c.Static }},
+	{"watch", "WATCH", "watch", "watch the input, templates and static folders and reload on changes", false, func(c *Config) interface{} { return &c.Watch }},
+	{"theme", "THEME", "theme", "theme of the website", false, func(c *Config) interface{} { return &c.Theme }},
+	{"base_url", "BASE_URL", "base-url", "URL or path the site is served under, e.g. https://example.com/portfolio/ or /portfolio", false, func(c *Config) interface{} { return &c.BaseURL }},
+	{"pretty_urls", "PRETTY_URLS", "pretty-urls", "link to pages with a trailing slash and write them as folder/index.html in the static build", false, func(c *Config) interface{} { return &c.PrettyURLs }},
+	{"server.port", "PORT", "port", "port of the webserver", false, func(c *Config) interface{} { return &c.Server.Port }},
+	{"server.read_timeout", "READ_TIMEOUT", "read-timeout", "maximum time to read a request including the body, 0 for none", false, func(c *Config) interface{} { return &c.Server.ReadTimeout }},
+	{"server.read_header_timeout", "READ_HEADER_TIMEOUT", "read-header-timeout", "maximum time to read the request headers", false, func(c *Config) interface{} { return &c.Server.ReadHeaderTimeout }},
+	{"server.write_timeout", "WRITE_TIMEOUT", "write-timeout", "maximum time to write a response, 0 for none", false, func(c *Config) interface{} { return &c.Server.WriteTimeout }},
+	{"server.idle_timeout", "IDLE_TIMEOUT", "idle-timeout", "how long idle keep-alive connections stay open", false, func(c *Config) interface{} { return &c.Server.IdleTimeout }},
+	{"server.max_header_bytes", "MAX_HEADER_BYTES", "max-header-bytes", "maximum size of the request headers in bytes", false, func(c *Config) interface{} { return &c.Server.MaxHeaderBytes }},
+	{"server.shutdown_timeout", "SHUTDOWN_TIMEOUT", "shutdown-timeout", "how long running requests may finish on shutdown", false, func(c *Config) interface{} { return &c.Server.ShutdownTimeout }},
+	{"server.home_timeout", "HOME_TIMEOUT", "home-timeout", "deadline for loading the data of the home page", false, func(c *Config) interface{} { return &c.Server.HomeTimeout }},
+	{"server.page_timeout", "PAGE_TIMEOUT", "page-timeout", "deadline for loading the data of the project, tool and impressum pages", false, func(c *Config) interface{} { return &c.Server.PageTimeout }},
+	{"server.compress", "COMPRESS", "compress", "compress text responses with brotli or gzip", false, func(c *Config) interface{} { return &c.Server.Compress }},
+	{"paths.input", "INPUT_DIR", "input", "folder with the zip file", false, func(c *Config) interface{} { return &c.Paths.Input }},
+	{"paths.zip", "ZIP_NAME", "zip", "name of the zip file in the input folder", false, func(c *Config) interface{} { return &c.Paths.Zip }},
+	{"paths.output", "OUTPUT_DIR", "output", "folder for the static build", false, func(c *Config) interface{} { return &c.Paths.Output }},
+	{"paths.json", "JSON_DIR", "json", "folder for the json files extracted from the zip file", false, func(c *Config) interface{} { return &c.Paths.JSON }},
+	{"paths.static", "STATIC_DIR", "static-dir", "folder for the images extracted from the zip file", false, func(c *Config) interface{} { return &c.Paths.Static }},
+	{"paths.assets", "ASSETS_DIR", "assets", "folder whose templates, static and themes files replace the embedded ones", false, func(c *Config) interface{} { return &c.Paths.Assets }},
+	{"paths.staging", "STAGING_DIR", "staging-dir", "folder for the uploaded zip files of the admin upload jobs", false, func(c *Config) interface{} { return &c.Paths.Staging }},
+	{"database.uri", "DB_URI", "db-uri", "connection string like mongodb+srv://cluster.example.com, replaces host and port", true, func(c *Config) interface{} { return &c.Database.URI }},
+	{"database.host", "DB_NAME", "db-host", "host name of the database or comma separated hosts of a replica set", false, func(c *Config) interface{} { return &c.Database.Host }},
+	{"database.port", "DB_PORT", "db-port", "port of the database", false, func(c *Config) interface{} { return &c.Database.Port }},
+	{"database.user", "DB_USER", "db-user", "user of the database", false, func(c *Config) interface{} { return &c.Database.User }},
+	{"database.password", "DB_PASS", "db-pass", "password of the database user", true, func(c *Config) interface{} { return &c.Database.Password }},
+	{"database.auth_source", "DB_AUTH_SOURCE", "db-auth-source", "database the user is defined in", false, func(c *Config) interface{} { return &c.Database.AuthSource }},
+	{"database.name", "DB_DATABASE", "db-name", "name of the database", false, func(c *Config) interface{} { return &c.Database.Name }},
+	{"database.replica_set", "DB_REPLICA_SET", "db-replica-set", "name of the replica set", false, func(c *Config) interface{} { return &c.Database.ReplicaSet }},
+	{"database.read_preference", "DB_READ_PREFERENCE", "db-read-preference", "primary, primaryPreferred, secondary, secondaryPreferred or nearest", false, func(c *Config) interface{} { return &c.Database.ReadPreference }},
+	{"database.max_pool_size", "DB_MAX_POOL_SIZE", "db-max-pool-size", "maximum number of connections, 0 for no limit", false, func(c *Config) interface{} { return &c.Database.MaxPoolSize }},
+	{"database.min_pool_size", "DB_MIN_POOL_SIZE", "db-min-pool-size", "number of connections kept open", false, func(c *Config) interface{} { return &c.Database.MinPoolSize }},
+	{"database.max_conn_idle_time", "DB_MAX_CONN_IDLE_TIME", "db-max-conn-idle-time", "how long an idle connection is kept, 0 for no limit", false, func(c *Config) interface{} { return &c.Database.MaxConnIdleTime }},
+	{"database.tls", "DB_TLS", "db-tls", "connect with TLS", false, func(c *Config) interface{} { return &c.Database.TLS }},
+	{"database.tls_ca_file", "DB_TLS_CA_FILE", "db-tls-ca-file", "PEM file with the certificate authorities the server certificate is checked against", false, func(c *Config) interface{} { return &c.Database.TLSCAFile }},
+	{"database.tls_cert_file", "DB_TLS_CERT_FILE", "db-tls-cert-file", "PEM file with the client certificate", false, func(c *Config) interface{} { return &c.Database.TLSCertFile }},
+	{"database.tls_key_file", "DB_TLS_KEY_FILE", "db-tls-key-file", "PEM file with the key of the client certificate, if it is not in the certificate file", false, func(c *Config) interface{} { return &c.Database.TLSKeyFile }},
+	{"database.timeout", "DB_TIMEOUT", "db-timeout", "timeout of database operations", false, func(c *Config) interface{} { return &c.Database.Timeout }},
+	{"database.connect_deadline", "DB_CONNECT_DEADLINE", "db-connect-deadline", "how long to retry connecting to the database before giving up", false, func(c *Config) interface{} { return &c.Database.ConnectDeadline }},
+	{"admin.tokens", "ADMIN_TOKENS", "admin-tokens", `admin tokens as "token:scope+scope,..."`, true, func(c *Config) interface{} { return &c.Admin.Tokens }},
+	{"admin.job_ttl", "ADMIN_JOB_TTL", "admin-job-ttl", "how long finished upload jobs are kept, ready jobs are discarded afterwards", false, func(c *Config) interface{} { return &c.Admin.JobTTL }},
+	{"cache.max_size", "CACHE_MAX_SIZE", "cache-max-size", "size in megabytes of the page cache, 0 disables caching", false, func(c *Config) interface{} { return &c.Cache.MaxSize }},
+	{"cache.html", "CACHE_CONTROL_HTML", "cache-control-html", "Cache-Control header of the pages and the static files under their own names", false, func(c *Config) interface{} { return &c.Cache.HTML }},
+	{"cache.assets", "CACHE_CONTROL_ASSETS", "cache-control-assets", "Cache-Control header of the fingerprinted static files", false, func(c *Config) interface{} { return &c.Cache.Assets }},
+	{"cache.images", "CACHE_CONTROL_IMAGES", "cache-control-images", "Cache-Control header of the imported images", false, func(c *Config) interface{} { return &c.Cache.Images }},
+	{"build.workers", "BUILD_WORKERS", "build-workers", "number of pages rendered at the same time, 0 for the number of CPUs", false, func(c *Config) interface{} { return &c.Build.Workers }},
+	{"build.minify", "BUILD_MINIFY", "minify", "minify the pages, stylesheets, scripts and SVG files", false, func(c *Config) interface{} { return &c.Build.Minify }},
+	{"build.fingerprint", "BUILD_FINGERPRINT", "fingerprint", "add the hash of their content to the names of the static files", false, func(c *Config) interface{} { return &c.Build.Fingerprint }},
+	{"build.compress", "BUILD_COMPRESS", "build-compress", "write a .gz and a .br file next to every text file of the static build", false, func(c *Config) interface{} { return &c.Build.Compress }},
+	{"build.archive", "BUILD_ARCHIVE", "archive", "package the static build as zip or tar.gz, empty for no archive", false, func(c *Config) interface{} { return &c.Build.Archive }},
+	{"build.check", "BUILD_CHECK", "check-links", "check the links of the static build: off, warn or fail", false, func(c *Config) interface{} { return &c.Build.Check }},
+	{"build.source_date_epoch", "SOURCE_DATE_EPOCH", "source-date-epoch", "modification time of the files in the build archive in seconds since 1970, 0 for 1980-01-01", false, func(c *Config) interface{} { return &c.Build.SourceDateEpoch }},
+	{"publish.target", "PUBLISH_TARGET", "publish-target", "where the static build is published: dir, s3 or git", false, func(c *Config) interface{} { return &c.Publish.Target }},
+	{"publish.dir", "PUBLISH_DIR", "publish-dir", "symlink that is switched to the published build, the releases are kept next to it", false, func(c *Config) interface{} { return &c.Publish.Dir }},
+	{"publish.keep", "PUBLISH_KEEP", "publish-keep", "number of earlier releases kept in the publish folder", false, func(c *Config) interface{} { return &c.Publish.Keep }},
+	{"publish.s3_endpoint", "PUBLISH_S3_ENDPOINT", "publish-s3-endpoint", "URL of the S3-compatible server, e.g. https://s3.eu-central-1.amazonaws.com", false, func(c *Config) interface{} { return &c.Publish.S3Endpoint }},
+	{"publish.s3_region", "PUBLISH_S3_REGION", "publish-s3-region", "region of the bucket", false, func(c *Config) interface{} { return &c.Publish.S3Region }},
+	{"publish.s3_bucket", "PUBLISH_S3_BUCKET", "publish-s3-bucket", "bucket the static build is uploaded to", false, func(c *Config) interface{} { return &c.Publish.S3Bucket }},
+	{"publish.s3_prefix", "PUBLISH_S3_PREFIX", "publish-s3-prefix", "folder in the bucket, empty for the root", false, func(c *Config) interface{} { return &c.Publish.S3Prefix }},
+	{"publish.s3_access_key", "PUBLISH_S3_ACCESS_KEY", "publish-s3-access-key", "access key of the bucket", false, func(c *Config) interface{} { return &c.Publish.S3AccessKey }},
+	{"publish.s3_secret_key", "PUBLISH_S3_SECRET_KEY", "publish-s3-secret-key", "secret key of the bucket", true, func(c *Config) interface{} { return &c.Publish.S3SecretKey }},
+	{"publish.git_repo", "PUBLISH_GIT_REPO", "publish-git-repo", "local git repository the static build is committed to", false, func(c *Config) interface{} { return &c.Publish.GitRepo }},
+	{"publish.git_branch", "PUBLISH_GIT_BRANCH", "publish-git-branch", "branch the static build is committed to", false, func(c *Config) interface{} { return &c.Publish.GitBranch }},
+	{"log.level", "LOG_LEVEL", "log-level", "minimum level of log records: debug, info, warn or error", false, func(c *Config) interface{} { return &c.Log.Level }},
+	{"log.format", "LOG_FORMAT", "log-format", "format of log records: logfmt or json", false, func(c *Config) interface{} { return &c.Log.Format }},
+	{"log.access_file", "ACCESS_LOG", "access-log", "file of the access log in the Combined Log Format, empty to disable it", false, func(c *Config) interface{} { return &c.Log.AccessFile }},
+	{"log.access_max_size", "ACCESS_LOG_MAX_SIZE", "access-log-max-size", "size in megabytes at which the access log is rotated", false, func(c *Config) interface{} { return &c.Log.AccessMaxSize }},
+	{"log.access_max_backups", "ACCESS_LOG_MAX_BACKUPS", "access-log-max-backups", "number of rotated access logs that are kept", false, func(c *Config) interface{} { return &c.Log.AccessMaxBackups }},
+}
+
+// defaultConfig returns the configuration with all default values
+func defaultConfig() Config {
+	return Config{
+		Theme: defaultTheme,
+		Server: ServerConfig{
+			Port:              8080,
+			ReadTimeout:       time.Minute,
+			ReadHeaderTimeout: 10 * time.Second,
+			WriteTimeout:      time.Minute,
+			IdleTimeout:       2 * time.Minute,
+			MaxHeaderBytes:    1 << 20,
+			ShutdownTimeout:   15 * time.Second,
+			HomeTimeout:       10 * time.Second,
+			PageTimeout:       5 * time.Second,
+			Compress:          true,
+		},
+		Paths: PathConfig{
+			Input:   "input",
+			Zip:     "resources.zip",
+			Output:  "output",
+			JSON:    "./json",
+			Static:  "./static",
+			Staging: "staging",
+		},
+		Database: DatabaseConfig{
+			Port:           27017,
+			Name:           "mydb",
+			ReadPreference: "primary",
+			MaxPoolSize:    100,
+			Timeout:        5 * time.Second,
+			// mongo needs a while on the first start of the container
+			ConnectDeadline: time.Minute,
+		},
+		Admin: AdminConfig{JobTTL: 24 * time.Hour},
+		Cache: CacheConfig{
+			MaxSize: 32,
+			// pages are revalidated on every request, they change with every import
+			HTML:   "no-cache",
+			Assets: "public, max-age=31536000, immutable",
+			Images: "public, max-age=86400",
+		},
+		Build: BuildConfig{Minify: true, Fingerprint: true, Compress: true, Check: "off"},
+		Publish: PublishConfig{
+			Keep:      2,
+			S3Region:  "us-east-1",
+			GitBranch: "gh-pages",
+		},
+		Log: LogConfig{
+			Level:            "info",
+			Format:           "logfmt",
+			AccessMaxSize:    10,
+			AccessMaxBackups: 5,
+		},
+	}
+}
+
+// configLoader registers the configuration flags on a flag set and loads the configuration after parsing
+type configLoader struct {
+	file    *string
+	print   *bool
+	flags   map[string]string
+	sources map[string]string
+	// requireDatabase is false for commands that do not use the database
+	requireDatabase bool
+}
+
+// configFlag is a flag that records its value, the values are applied after the file and environment
+type configFlag struct {
+	loader *configLoader
+	name   string
+	isBool bool
+}
+
+// String returns the recorded value of the flag
+func (f *configFlag) String() string {
+	if f.loader == nil {
+		return ""
+	}
+	return f.loader.flags[f.name]
+}
+
+// Set records the value of the flag
+func (f *configFlag) Set(value string) error {
+	f.loader.flags[f.name] = value
+	return nil
+}
+
+// IsBoolFlag lets boolean flags be used without a value
+func (f *configFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// newConfigLoader registers the -config and -print-config flags and a flag for every setting
+func newConfigLoader(fs *flag.FlagSet) *configLoader {
+	l := &configLoader{flags: make(map[string]string), sources: make(map[string]string), requireDatabase: true}
+	l.file = fs.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML configuration file (CONFIG_FILE)")
+	l.print = fs.Bool("print-config", false, "print the configuration with redacted secrets and exit")
+	defaults := defaultConfig()
+	for _, s := range settings {
+		_, isBool := s.field(&defaults).(*bool)
+		usage := fmt.Sprintf("%s (%s, %s)", s.usage, s.env, s.key)
+		fs.Var(&configFlag{loader: l, name: s.flag, isBool: isBool}, s.flag, usage)
+	}
+	return l
+}
+
+// load loads the configuration from the defaults, the configuration file, the environment and the flags
+// all invalid settings are reported together
+func (l *configLoader) load() (Config, error) {
+	c := defaultConfig()
+	var problems []string
+	set := func(s setting, value string, source string) {
+		err := setField(s.field(&c), value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v (from %s)", s.key, err, source))
+			return
+		}
+		l.sources[s.key] = source
+	}
+
+	if *l.file != "" {
+		values, err := readConfigFile(*l.file)
+		if err != nil {
+			return c, fmt.Errorf("invalid configuration file %s: %w", *l.file, err)
+		}
+		known := make(map[string]bool)
+		for _, s := range settings {
+			known[s.key] = true
+			if value, ok := values[s.key]; ok {
+				set(s, value, *l.file)
+			}
+		}
+		for key := range values {
+			if !known[key] {
+				problems = append(problems, fmt.Sprintf("%s: unknown setting (from %s)", key, *l.file))
+			}
+		}
+	}
+
+	for _, s := range settings {
+		value, source, err := lookupEnv(s.env)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", s.key, err))
+		} else if source != "" {
+			set(s, value, source)
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := l.flags[s.flag]; ok {
+			set(s, value, "flag -"+s.flag)
+		}
+	}
+
+	problems = append(problems, c.validate(l.requireDatabase)...)
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return c, fmt.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	return c, nil
+}
+
+// lookupEnv returns the value of an environment variable or of the file named in its _FILE variant
+// the source is empty if neither is set, a variable set to an empty value sets the empty value
+func lookupEnv(env string) (string, string, error) {
+	if path, ok := os.LookupEnv(env + "_FILE"); ok {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", env + "_FILE", fmt.Errorf("could not read %s_FILE: %w", env, err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), env + "_FILE", nil
+	}
+	if value, ok := os.LookupEnv(env); ok {
+		return value, env, nil
+	}
+	return "", "", nil
+}
+
+// readConfigFile reads a YAML or TOML file into a map of the dotted setting keys to their values
+func readConfigFile(path string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &raw)
+	case ".toml":
+		err = toml.Unmarshal(content, &raw)
+	default:
+		return nil, fmt.Errorf("unknown file type %q, use .yaml, .yml or .toml", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	flattenConfig("", raw, values)
+	return values, nil
+}
+
+// flattenConfig adds the values of a nested map to values with their dotted keys
+func flattenConfig(prefix string, raw interface{}, values map[string]string) {
+	switch v := raw.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			flattenConfig(prefix+key+".", value, values)
+		}
+	case map[interface{}]interface{}:
+		for key, value := range v {
+			flattenConfig(prefix+fmt.Sprint(key)+".", value, values)
+		}
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, value := range v {
+			list = append(list, fmt.Sprint(value))
+		}
+		values[strings.TrimSuffix(prefix, ".")] = strings.Join(list, ",")
+	default:
+		values[strings.TrimSuffix(prefix, ".")] = fmt.Sprint(v)
+	}
+}
+
+// setField parses the value into the field the pointer points to
+func setField(field interface{}, value string) error {
+	switch f := field.(type) {
+	case *string:
+		*f = value
+	case *bool:
+		// "1" and "0" are used by the environment variables
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		*f = b
+	case *int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		*f = i
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration like 5s", value)
+		}
+		*f = d
+	default:
+		return fmt.Errorf("unsupported type %T", field)
+	}
+	return nil
+}
+
+// databaseNamePattern matches the names MongoDB allows for databases, leaving room for the staging suffix
+// a staging database adds "_staging_" and a job id of 16 characters and must stay below 64 characters
+var databaseNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,38}$`)
+
+// validate returns a message for every invalid setting, the database host is only required with database
+func (c Config) validate(database bool) []string {
+	var problems []string
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("server.port: must be between 1 and 65535, got %d", c.Server.Port))
+	}
+	timeouts := map[string]time.Duration{
+		"server.read_timeout":  c.Server.ReadTimeout,
+		"server.write_timeout": c.Server.WriteTimeout,
+		"server.idle_timeout":  c.Server.IdleTimeout,
+	}
+	for key, timeout := range timeouts {
+		if timeout < 0 {
+			problems = append(problems, fmt.Sprintf("%s: must not be negative, got %v", key, timeout))
+		}
+	}
+	if c.Server.WriteTimeout > 0 && c.Server.WriteTimeout < 2*time.Second {
+		problems = append(problems, fmt.Sprintf("server.write_timeout: must be 0 or at least 2s, got %v", c.Server.WriteTimeout))
+	}
+	if c.Server.ReadHeaderTimeout <= 0 {
+		problems = append(problems, fmt.Sprintf("server.read_header_timeout: must be positive, got %v", c.Server.ReadHeaderTimeout))
+	}
+	if c.Server.MaxHeaderBytes < 4096 {
+		problems = append(problems, fmt.Sprintf("server.max_header_bytes: must be at least 4096, got %d", c.Server.MaxHeaderBytes))
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		problems = append(problems, fmt.Sprintf("server.shutdown_timeout: must be positive, got %v", c.Server.ShutdownTimeout))
+	}
+	if c.Server.HomeTimeout <= 0 {
+		problems = append(problems, fmt.Sprintf("server.home_timeout: must be positive, got %v", c.Server.HomeTimeout))
+	}
+	if c.Server.PageTimeout <= 0 {
+		problems = append(problems, fmt.Sprintf("server.page_timeout: must be positive, got %v", c.Server.PageTimeout))
+	}
+	if c.Theme == "" {
+		problems = append(problems, "theme: must not be empty")
+	}
+	if c.BaseURL != "" {
+		u, err := url.Parse(c.BaseURL)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("base_url: %v", err))
+		case u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https":
+			problems = append(problems, fmt.Sprintf("base_url: must be an http or https URL or a path, got %q", c.BaseURL))
+		case u.Scheme == "" && !strings.HasPrefix(c.BaseURL, "/"):
+			problems = append(problems, fmt.Sprintf("base_url: a path must start with /, got %q", c.BaseURL))
+		case u.RawQuery != "" || u.Fragment != "":
+			problems = append(problems, fmt.Sprintf("base_url: must not have a query or fragment, got %q", c.BaseURL))
+		}
+	}
+	for key, dir := range map[string]string{"paths.input": c.Paths.Input, "paths.output": c.Paths.Output, "paths.json": c.Paths.JSON, "paths.static": c.Paths.Static, "paths.staging": c.Paths.Staging} {
+		if dir == "" {
+			problems = append(problems, key+": must not be empty")
+		}
+	}
+	if c.Paths.Zip == "" || strings.ContainsAny(c.Paths.Zip, `/\`) {
+		problems = append(problems, fmt.Sprintf("paths.zip: must be a file name in the input folder, got %q", c.Paths.Zip))
+	}
+	if database && c.Database.Host == "" && c.Database.URI == "" {
+		problems = append(problems, "database.host: must be set (DB_NAME) unless database.uri is set")
+	}
+	if c.Database.URI != "" && !strings.HasPrefix(c.Database.URI, "mongodb://") && !strings.HasPrefix(c.Database.URI, "mongodb+srv://") {
+		problems = append(problems, "database.uri: must start with mongodb:// or mongodb+srv://")
+	}
+	if _, err := readpref.ModeFromString(c.Database.ReadPreference); err != nil || c.Database.ReadPreference == "" {
+		problems = append(problems, fmt.Sprintf("database.read_preference: must be primary, primaryPreferred, secondary, secondaryPreferred or nearest, got %q", c.Database.ReadPreference))
+	}
+	if c.Database.MaxPoolSize < 0 || c.Database.MinPoolSize < 0 {
+		problems = append(problems, "database.max_pool_size and database.min_pool_size: must not be negative")
+	} else if c.Database.MaxPoolSize > 0 && c.Database.MinPoolSize > c.Database.MaxPoolSize {
+		problems = append(problems, fmt.Sprintf("database.min_pool_size: must not be larger than database.max_pool_size %d, got %d", c.Database.MaxPoolSize, c.Database.MinPoolSize))
+	}
+	if c.Database.MaxConnIdleTime < 0 {
+		problems = append(problems, fmt.Sprintf("database.max_conn_idle_time: must not be negative, got %v", c.Database.MaxConnIdleTime))
+	}
+	if c.Database.TLSKeyFile != "" && c.Database.TLSCertFile == "" {
+		problems = append(problems, "database.tls_key_file: needs database.tls_cert_file")
+	}
+	if _, err := c.Database.tlsConfig(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.Database.Port < 1 || c.Database.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("database.port: must be between 1 and 65535, got %d", c.Database.Port))
+	}
+	if (c.Database.User == "") != (c.Database.Password == "") {
+		problems = append(problems, "database.user and database.password: must be set together")
+	}
+	if !databaseNamePattern.MatchString(c.Database.Name) {
+		problems = append(problems, fmt.Sprintf("database.name: must be 1 to 38 letters, digits, _ or -, got %q", c.Database.Name))
+	}
+	if c.Database.Timeout <= 0 {
+		problems = append(problems, fmt.Sprintf("database.timeout: must be positive, got %v", c.Database.Timeout))
+	}
+	if c.Database.ConnectDeadline < 0 {
+		problems = append(problems, fmt.Sprintf("database.connect_deadline: must not be negative, got %v", c.Database.ConnectDeadline))
+	}
+	if c.Cache.MaxSize < 0 {
+		problems = append(problems, fmt.Sprintf("cache.max_size: must not be negative, got %d", c.Cache.MaxSize))
+	}
+	if c.Build.Workers < 0 {
+		problems = append(problems, fmt.Sprintf("build.workers: must not be negative, got %d", c.Build.Workers))
+	}
+	if c.Build.Archive != "" && c.Build.Archive != "zip" && c.Build.Archive != "tar.gz" {
+		problems = append(problems, fmt.Sprintf("build.archive: must be zip, tar.gz or empty, got %q", c.Build.Archive))
+	}
+	if c.Build.Check != "off" && c.Build.Check != "warn" && c.Build.Check != "fail" {
+		problems = append(problems, fmt.Sprintf("build.check: must be off, warn or fail, got %q", c.Build.Check))
+	}
+	if c.Build.SourceDateEpoch < 0 {
+		problems = append(problems, fmt.Sprintf("build.source_date_epoch: must not be negative, got %d", c.Build.SourceDateEpoch))
+	}
+	problems = append(problems, c.Publish.validate()...)
+	if _, ok := logLevels[c.Log.Level]; !ok {
+		problems = append(problems, fmt.Sprintf("log.level: must be debug, info, warn or error, got %q", c.Log.Level))
+	}
+	if c.Log.Format != "logfmt" && c.Log.Format != "json" {
+		problems = append(problems, fmt.Sprintf("log.format: must be logfmt or json, got %q", c.Log.Format))
+	}
+	if c.Log.AccessMaxSize < 1 {
+		problems = append(problems, fmt.Sprintf("log.access_max_size: must be at least 1, got %d", c.Log.AccessMaxSize))
+	}
+	if c.Log.AccessMaxBackups < 0 {
+		problems = append(problems, fmt.Sprintf("log.access_max_backups: must not be negative, got %d", c.Log.AccessMaxBackups))
+	}
+	if c.Admin.JobTTL <= 0 {
+		problems = append(problems, fmt.Sprintf("admin.job_ttl: must be positive, got %v", c.Admin.JobTTL))
+	}
+	tokens, err := parseAdminTokens(c.Admin.Tokens)
+	if err != nil {
+		problems = append(problems, "admin.tokens: "+err.Error())
+	}
+	for token, scopes := range tokens {
+		for _, scope := range scopes {
+			if scope != scopeUpload && scope != scopePreview && scope != scopePublish && scope != "*" {
+				problems = append(problems, fmt.Sprintf("admin.tokens: unknown scope %q of token %s", scope, redact(token)))
+			}
+		}
+	}
+	return problems
+}
+
+// validate returns the problems of the publish settings, the settings of other targets than the selected one are not checked
+func (p PublishConfig) validate() []string {
+	var problems []string
+	if p.Keep < 0 {
+		problems = append(problems, fmt.Sprintf("publish.keep: must not be negative, got %d", p.Keep))
+	}
+	switch p.Target {
+	case "":
+	case "dir":
+		if p.Dir == "" {
+			problems = append(problems, "publish.dir: is required for the target dir")
+		}
+	case "s3":
+		if u, err := url.Parse(p.S3Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("publish.s3_endpoint: must be an http or https URL, got %q", p.S3Endpoint))
+		}
+		if p.S3Bucket == "" || p.S3AccessKey == "" || p.S3SecretKey == "" {
+			problems = append(problems, "publish.s3_bucket, publish.s3_access_key and publish.s3_secret_key: are required for the target s3")
+		}
+	case "git":
+		if p.GitRepo == "" || p.GitBranch == "" {
+			problems = append(problems, "publish.git_repo and publish.git_branch: are required for the target git")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("publish.target: must be dir, s3, git or empty, got %q", p.Target))
+	}
+	return problems
+}
+
+// printConfig prints every setting with its source, secrets are redacted
+func (l *configLoader) printConfig(c Config) {
+	for _, s := range settings {
+		value := fmt.Sprint(derefField(s.field(&c)))
+		if s.secret && value != "" {
+			value = redact(value)
+		}
+		source := l.sources[s.key]
+		if source == "" {
+			source = "default"
+		}
+		fmt.Printf("%-18s = %-24s (%s)\n", s.key, value, source)
+	}
+}
+
+// derefField returns the value the field pointer points to
+func derefField(field interface{}) interface{} {
+	switch f := field.(type) {
+	case *string:
+		return *f
+	case *bool:
+		return *f
+	case *int:
+		return *f
+	case *time.Duration:
+		return *f
+	}
+	return field
+}
+
+// redact hides a secret value
+func redact(string) string {
+	return "[redacted]"
+}
+
+// basePath returns the path of the base URL without a trailing slash, "" if the site is served at the root
+func basePath() string {
+	u, err := url.Parse(cfg.BaseURL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+// buildDir returns the folder of the static build in the output folder
+func buildDir() string {
+	return cfg.Paths.Output + "/webapp_build"
+}
@@ -6,21 +6,31 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+	"io/fs"
 	"io/ioutil"
-	"log"
-	"net/http"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	timeout      = 5 * time.Second
 	projects     = "projects"
 	otherskills  = "otherskills"
 	education    = "education"
@@ -29,303 +39,905 @@ const (
 	proglanguage = "proglanguage"
 )
 
+// collections lists every collection that is imported from a json file with the same name
+var collections = []string{projects, otherskills, education, software, language, proglanguage}
+
+var (
+	// errNotFound is returned if a project or tool does not exist
+	errNotFound = errors.New("not found")
+	// errDatabaseUnavailable is returned if the database cannot be reached
+	errDatabaseUnavailable = errors.New("database unavailable")
+)
+
+const (
+	// minBackoff is the wait after the first failed connection attempt, it doubles with every further failure
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
 var (
 	client *mongo.Client
 	mux    sync.Mutex
+	// backoff is the current wait between connection attempts and nextAttempt the earliest time of the next one,
+	// so requests fail fast while the database is down instead of each waiting for a connection timeout
+	backoff     time.Duration
+	nextAttempt time.Time
+	// connecting is the running connection attempt or nil
+	connecting *connectAttempt
+	// importing is 1 while json files are imported into the configured database
+	importing int32
+	// liveDB is the name of the database the web server serves from, it is switched when an upload is published
+	// and read from the configured database after connecting, see loadLiveDatabase
+	liveDB  string
+	liveMux sync.RWMutex
 )
 
+// dbKey is the context key for the name of the database that should be used instead of the live database
+type dbKey struct{}
+
+// withDatabase returns a context that makes all database functions use the database with the given name
+func withDatabase(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, dbKey{}, name)
+}
+
+// databaseName returns the database name stored in the context or the name of the live database
+func databaseName(ctx context.Context) string {
+	if name, ok := ctx.Value(dbKey{}).(string); ok && name != "" {
+		return name
+	}
+	return getLiveDatabase()
+}
+
+// imgKey is the context key for the images that should be used instead of the images of the static folder
+type imgKey struct{}
+
+// withImages returns a context that makes checkImage look up the images in the given file system
+func withImages(ctx context.Context, images fs.FS) context.Context {
+	return context.WithValue(ctx, imgKey{}, images)
+}
+
+// imageFiles returns the images stored in the context or the images extracted to the static folder
+func imageFiles(ctx context.Context) fs.FS {
+	if images, ok := ctx.Value(imgKey{}).(fs.FS); ok {
+		return images
+	}
+	return os.DirFS(cfg.Paths.Static)
+}
+
+// getLiveDatabase returns the name of the database the web server serves from
+func getLiveDatabase() string {
+	liveMux.RLock()
+	defer liveMux.RUnlock()
+	return liveDB
+}
+
+// setLiveDatabase switches the database the web server serves from and returns the name of the previous one
+func setLiveDatabase(name string) string {
+	liveMux.Lock()
+	defer liveMux.Unlock()
+	previous := liveDB
+	liveDB = name
+	return previous
+}
+
 // getDatabase returns the database in a thread safe way in a singleton pattern
-func getDatabase(ctx context.Context) *mongo.Database {
+// the database name is taken from the context, see withDatabase
+// only one connection attempt runs at a time, concurrent calls wait for it until their context ends;
+// if the database cannot be reached an error wrapping errDatabaseUnavailable is returned,
+// connection attempts are repeated with exponential backoff by later calls
+func getDatabase(ctx context.Context) (*mongo.Database, error) {
+	mux.Lock()
+	if client != nil {
+		c := client
+		mux.Unlock()
+		return c.Database(databaseName(ctx)), nil
+	}
+	attempt := connecting
+	if attempt == nil {
+		if wait := time.Until(nextAttempt); wait > 0 {
+			mux.Unlock()
+			return nil, fmt.Errorf("%w: next connection attempt in %v", errDatabaseUnavailable, wait.Round(time.Millisecond))
+		}
+		attempt = &connectAttempt{done: make(chan struct{})}
+		connecting = attempt
+		go attempt.run()
+	}
+	mux.Unlock()
+
+	select {
+	case <-attempt.done:
+	case <-ctx.Done():
+		// the caller gave up, which says nothing about the database
+		return nil, fmt.Errorf("could not connect: %w", ctx.Err())
+	}
+	if attempt.err != nil {
+		return nil, attempt.err
+	}
+	return attempt.client.Database(databaseName(ctx)), nil
+}
+
+// connectAttempt is a connection attempt shared by the calls of getDatabase while it runs
+type connectAttempt struct {
+	// done is closed when the attempt is over, client or err is set then
+	done   chan struct{}
+	client *mongo.Client
+	err    error
+}
+
+// run connects to the database and reads the live database, see loadLiveDatabase
+// it has its own timeout, so a caller that gives up does not end the attempt of the others
+func (a *connectAttempt) run() {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Database.Timeout)
+	defer cancel()
+	c, err := connect(ctx)
+	live := ""
+	if err == nil {
+		live, err = loadLiveDatabase(ctx, c)
+		if err != nil {
+			_ = c.Disconnect(context.Background())
+		}
+	}
+
 	mux.Lock()
 	defer mux.Unlock()
-	// singleton client
-	if client == nil {
-		var err error
-		name := os.Getenv("DB_NAME")
-		user := os.Getenv("DB_USER")
-		pass := os.Getenv("DB_PASS")
-		port := os.Getenv("DB_PORT")
-		host := "mongodb://" + user + ":" + pass + "@" + name + ":" + port
-		log.Println("connecting to database: ", host)
-		client, err = mongo.Connect(ctx, options.Client().ApplyURI(host))
+	defer close(a.done)
+	connecting = nil
+	if err != nil {
+		backoff *= 2
+		if backoff < minBackoff {
+			backoff = minBackoff
+		}
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		nextAttempt = time.Now().Add(backoff)
+		a.err = fmt.Errorf("%w: %v", errDatabaseUnavailable, err)
+		return
+	}
+	setLiveDatabase(live)
+	client = c
+	backoff = 0
+	a.client = c
+}
+
+// connect connects to the database and checks the connection with a ping
+func connect(ctx context.Context) (*mongo.Client, error) {
+	opts, err := clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	appLog.Info("connecting to database", "hosts", strings.Join(opts.Hosts, ","), "user", cfg.Database.User,
+		"tls", opts.TLSConfig != nil, "read_preference", cfg.Database.ReadPreference)
+	c, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect: %w", err)
+	}
+	err = c.Ping(ctx, opts.ReadPreference)
+	if err != nil {
+		_ = c.Disconnect(context.Background())
+		return nil, fmt.Errorf("could not ping: %w", err)
+	}
+	appLog.Info("connected to database")
+	return c, nil
+}
+
+// clientOptions returns the options of the database client from the configuration
+// the settings of the configuration take precedence over the ones in the connection string
+func clientOptions() (*options.ClientOptions, error) {
+	uri := cfg.Database.URI
+	if uri == "" {
+		hosts := strings.Split(cfg.Database.Host, ",")
+		for i, host := range hosts {
+			host = strings.TrimSpace(host)
+			if _, _, err := net.SplitHostPort(host); err != nil {
+				host = net.JoinHostPort(host, strconv.Itoa(cfg.Database.Port))
+			}
+			hosts[i] = host
+		}
+		uri = (&url.URL{Scheme: "mongodb", Host: strings.Join(hosts, ","), Path: "/"}).String()
+	}
+	opts := options.Client().ApplyURI(uri).SetMonitor(commandMonitor())
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("could not use connection string: %w", err)
+	}
+
+	// the credentials are passed as options, so they need no escaping
+	if cfg.Database.User != "" || cfg.Database.AuthSource != "" {
+		credential := options.Credential{}
+		if opts.Auth != nil {
+			credential = *opts.Auth
+		}
+		if cfg.Database.User != "" {
+			credential.Username = cfg.Database.User
+			credential.Password = cfg.Database.Password
+			credential.PasswordSet = true
+		}
+		if cfg.Database.AuthSource != "" {
+			credential.AuthSource = cfg.Database.AuthSource
+		}
+		opts.SetAuth(credential)
+	}
+	if cfg.Database.ReplicaSet != "" {
+		opts.SetReplicaSet(cfg.Database.ReplicaSet)
+	}
+	mode, err := readpref.ModeFromString(cfg.Database.ReadPreference)
+	if err != nil {
+		return nil, err
+	}
+	pref, err := readpref.New(mode)
+	if err != nil {
+		return nil, err
+	}
+	opts.SetReadPreference(pref)
+	opts.SetMaxPoolSize(uint64(cfg.Database.MaxPoolSize))
+	opts.SetMinPoolSize(uint64(cfg.Database.MinPoolSize))
+	if cfg.Database.MaxConnIdleTime > 0 {
+		opts.SetMaxConnIdleTime(cfg.Database.MaxConnIdleTime)
+	}
+	tlsConfig, err := cfg.Database.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	return opts, nil
+}
+
+// tlsConfig returns the TLS configuration of the database connection or nil if TLS is not configured here
+func (d DatabaseConfig) tlsConfig() (*tls.Config, error) {
+	if !d.TLS && d.TLSCAFile == "" && d.TLSCertFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if d.TLSCAFile != "" {
+		ca, err := ioutil.ReadFile(d.TLSCAFile)
 		if err != nil {
-			log.Fatalln("could not connect to database: ", err)
+			return nil, fmt.Errorf("database.tls_ca_file: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("database.tls_ca_file: no certificates in %s", d.TLSCAFile)
+		}
+	}
+	if d.TLSCertFile != "" {
+		keyFile := d.TLSKeyFile
+		if keyFile == "" {
+			keyFile = d.TLSCertFile
 		}
-		err = client.Ping(ctx, readpref.Primary())
+		certificate, err := tls.LoadX509KeyPair(d.TLSCertFile, keyFile)
 		if err != nil {
-			log.Fatalln("could not ping database: ", err)
+			return nil, fmt.Errorf("database.tls_cert_file: %w", err)
 		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+// waitForDatabase connects to the database and retries until cfg.Database.ConnectDeadline is over
+// it is used before the commands that cannot work without the database
+func waitForDatabase() error {
+	deadline := time.Now().Add(cfg.Database.ConnectDeadline)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Database.Timeout)
+		_, err := getDatabase(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		mux.Lock()
+		wait := time.Until(nextAttempt)
+		mux.Unlock()
+		if time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("database not reachable within %v: %w", cfg.Database.ConnectDeadline, err)
+		}
+		appLog.Warn("database not reachable, retrying", "wait", wait.Round(time.Millisecond), "error", err)
+		time.Sleep(wait)
+	}
+}
+
+// closeDatabase disconnects the client from the database
+func closeDatabase(ctx context.Context) {
+	mux.Lock()
+	defer mux.Unlock()
+	if client == nil {
+		return
+	}
+	err := client.Disconnect(ctx)
+	if err != nil {
+		appLog.Warn("could not disconnect from database", "error", err)
+	}
+	client = nil
+	appLog.Info("disconnected from database")
+}
+
+// pingDatabase checks that the database can be reached right now
+func pingDatabase(ctx context.Context) error {
+	database, err := getDatabase(ctx)
+	if err != nil {
+		return err
+	}
+	err = database.Client().Ping(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%w: could not ping: %v", errDatabaseUnavailable, err)
 	}
-	return client.Database("mydb")
+	return nil
+}
+
+// checkImported returns an error if the import into the database of the context is running or has not happened
+func checkImported(ctx context.Context) error {
+	if atomic.LoadInt32(&importing) == 1 && databaseName(ctx) == cfg.Database.Name {
+		return fmt.Errorf("import is running")
+	}
+	database, err := getDatabase(ctx)
+	if err != nil {
+		return err
+	}
+	count, err := database.Collection(projects).CountDocuments(ctx, bson.M{}, options.Count().SetLimit(1))
+	if err != nil {
+		return fmt.Errorf("could not count %s: %w", projects, err)
+	}
+	if count == 0 {
+		return fmt.Errorf("no content imported")
+	}
+	return nil
+}
+
+// isUnavailable reports if the error is caused by a database that cannot be reached
+func isUnavailable(err error) bool {
+	var selection topology.ServerSelectionError
+	return errors.Is(err, errDatabaseUnavailable) || errors.As(err, &selection) ||
+		mongo.IsNetworkError(err) || mongo.IsTimeout(err)
 }
 
 // buildDatabase  reads all json files for each category and inserts them into the database
 // this is used in main.go to build the database every time the app starts
-func buildDatabase() {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+func buildDatabase() error {
+	err := waitForDatabase()
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&importing, 1)
+	defer atomic.StoreInt32(&importing, 0)
+	err = importJSON(withDatabase(context.Background(), cfg.Database.Name), cfg.Paths.JSON, nil)
+	if err != nil {
+		return fmt.Errorf("could not import json files: %w", err)
+	}
+	// the imported data replaces the data of a published upload
+	err = switchLiveDatabase(cfg.Database.Name)
+	if err != nil {
+		return err
+	}
+	dropStagingDatabases()
+	return nil
+}
+
+// liveCollection is the collection of the configured database that records the live database after a publish,
+// so the published data is served again after a restart
+const liveCollection = "live"
+
+// loadLiveDatabase returns the live database recorded in the configured database or the configured database itself
+func loadLiveDatabase(ctx context.Context, c *mongo.Client) (string, error) {
+	var record struct {
+		Database string `bson:"database"`
+	}
+	err := c.Database(cfg.Database.Name).Collection(liveCollection).FindOne(ctx, bson.M{"_id": liveCollection}).Decode(&record)
+	if errors.Is(err, mongo.ErrNoDocuments) || err == nil && record.Database == "" {
+		return cfg.Database.Name, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not read live database: %w", err)
+	}
+	return record.Database, nil
+}
+
+// saveLiveDatabase records the live database in the configured database, the record is removed for the configured database
+func saveLiveDatabase(ctx context.Context, name string) error {
+	database, err := getDatabase(withDatabase(ctx, cfg.Database.Name))
+	if err != nil {
+		return err
+	}
+	collection := database.Collection(liveCollection)
+	if name == cfg.Database.Name {
+		_, err = collection.DeleteOne(ctx, bson.M{"_id": liveCollection})
+	} else {
+		_, err = collection.ReplaceOne(ctx, bson.M{"_id": liveCollection}, bson.M{"_id": liveCollection, "database": name},
+			options.Replace().SetUpsert(true))
+	}
+	if err != nil {
+		return fmt.Errorf("could not save live database: %w", err)
+	}
+	return nil
+}
+
+// switchLiveDatabase makes the database with the given name the live database and records it for the next start
+// the previous live database is dropped unless it is the configured database
+func switchLiveDatabase(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Database.Timeout)
 	defer cancel()
+	err := saveLiveDatabase(ctx, name)
+	if err != nil {
+		return err
+	}
+	previous := setLiveDatabase(name)
+	invalidateCaches()
+	appLog.Info("live database switched", "database", name)
+	if previous != cfg.Database.Name && previous != name {
+		dropDatabase(previous)
+	}
+	return nil
+}
 
-	readJSONFileToDatabase(ctx, "json/projects.json", projects)
-	readJSONFileToDatabase(ctx, "json/otherskills.json", otherskills)
-	readJSONFileToDatabase(ctx, "json/education.json", education)
-	readJSONFileToDatabase(ctx, "json/software.json", software)
-	readJSONFileToDatabase(ctx, "json/language.json", language)
-	readJSONFileToDatabase(ctx, "json/proglanguage.json", proglanguage)
+// stagingPrefix returns the prefix of the names of the staging databases of upload jobs and watch mode imports
+// only databases with this prefix are ever dropped as left over, so other databases next to the live one are safe
+func stagingPrefix() string {
+	return cfg.Database.Name + "_staging_"
 }
 
-// readJSONFileToDatabase reads a json file and inserts it into the database
-func readJSONFileToDatabase(ctx context.Context, filename string, collection string) {
-	myCollection := getDatabase(ctx).Collection(collection)
-	err := myCollection.Drop(ctx)
+// dropStagingDatabases drops the databases left over from upload jobs and watch mode imports of a previous run,
+// the live database and the databases of the current upload jobs are kept
+func dropStagingDatabases() {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Database.Timeout)
+	defer cancel()
+	database, err := getDatabase(ctx)
+	if err != nil {
+		appLog.Warn("could not list staging databases", "error", err)
+		return
+	}
+	names, err := database.Client().ListDatabaseNames(ctx, bson.M{"name": bson.M{"$regex": "^" + regexp.QuoteMeta(stagingPrefix())}})
+	if err != nil {
+		appLog.Warn("could not list staging databases", "error", err)
+		return
+	}
+	for _, name := range names {
+		if name != getLiveDatabase() && !jobDatabase(name) {
+			dropDatabase(name)
+		}
+	}
+}
+
+// dropDatabase drops the database with the given name
+func dropDatabase(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Database.Timeout)
+	defer cancel()
+	database, err := getDatabase(ctx)
+	if err == nil {
+		err = database.Client().Database(name).Drop(ctx)
+	}
+	if err != nil {
+		appLog.Warn("could not drop database", "database", name, "error", err)
+		return
+	}
+	appLog.Info("dropped database", "database", name)
+}
+
+// importJSON reads the json file of every collection from dir and inserts it into the database of the context
+// progress is called after each collection with the number of inserted entries and may be nil
+func importJSON(ctx context.Context, dir string, progress func(collection string, count int)) error {
+	start := time.Now()
+	counts := make(map[string]int)
+	for _, collection := range collections {
+		cctx, cancel := context.WithTimeout(ctx, cfg.Database.Timeout)
+		count, err := readJSONFileToDatabase(cctx, filepath.Join(dir, collection+".json"), collection)
+		cancel()
+		if err != nil {
+			importsTotal.add(1, "error")
+			return fmt.Errorf("import %s: %w", collection, err)
+		}
+		counts[collection] = count
+		if progress != nil {
+			progress(collection, count)
+		}
+	}
+	importsTotal.add(1, "ok")
+	invalidateCaches()
+	importDuration.since(start)
+	for collection, count := range counts {
+		importDocuments.set(float64(count), collection)
+	}
+	return nil
+}
+
+// readJSONFileToDatabase reads a json file and inserts it into the database, it returns the number of inserted entries
+// the collection is recreated with its indexes, see indexes.go
+func readJSONFileToDatabase(ctx context.Context, filename string, collection string) (int, error) {
+	database, err := getDatabase(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// check the file before the collection is dropped
+	content, err := readJSON(filename)
+	if err != nil {
+		return 0, err
+	}
+	err = checkDuplicateIDs(collection, content)
+	if err != nil {
+		return 0, err
+	}
+	myCollection := database.Collection(collection)
+	err = myCollection.Drop(ctx)
 	if err != nil {
-		log.Println("could not drop collection ", err)
+		logFor(ctx).Warn("could not drop collection", "collection", collection, "error", err)
+	}
+	err = createIndexes(ctx, myCollection)
+	if err != nil {
+		return 0, err
 	}
-	content := readJSON(filename)
 	_, err = myCollection.InsertMany(ctx, content)
+	if mongo.IsDuplicateKeyError(err) {
+		return 0, fmt.Errorf("%w in %s.json: %v", errDuplicateID, collection, err)
+	}
 	if err != nil {
-		log.Fatalln("could not insert entries: ", err)
-	} else {
-		log.Printf("inserted entries: %v to %v \n", len(content), collection)
+		return 0, fmt.Errorf("could not insert entries: %w", err)
 	}
+	logFor(ctx).Info("inserted entries", "collection", collection, "count", len(content))
+	return len(content), nil
 }
 
 // readJSON reads a json file, converts returns it as a database suitable slice of bson.M
-func readJSON(filePath string) bson.A {
+func readJSON(filePath string) (bson.A, error) {
 	jsonFile, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		log.Fatalln("could not read file: ", err)
+		return nil, fmt.Errorf("could not read file: %w", err)
 	}
 	var bsonData bson.A
 	err = json.Unmarshal(jsonFile, &bsonData)
 	if err != nil {
-		log.Fatalln("could not unmarshal json: ", err)
+		return nil, fmt.Errorf("could not unmarshal json: %w", err)
+	}
+	return bsonData, nil
+}
+
+// exportCollection returns all documents of a collection without their database ids
+func exportCollection(ctx context.Context, collection string) ([]bson.M, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Database.Timeout)
+	defer cancel()
+	database, err := getDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := database.Collection(collection).Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"_id": 0}))
+	if err != nil {
+		return nil, fmt.Errorf("could not find %s: %w", collection, err)
+	}
+	docs := []bson.M{}
+	err = cursor.All(ctx, &docs)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode %s: %w", collection, err)
+	}
+	return docs, nil
+}
+
+// getProjectFromDatabase returns one project from the database as a ProductPage
+// if the project does not exist, the returned page says so and the error wraps errNotFound
+func getProjectFromDatabase(ctx context.Context, id string) (ProductPage, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Database.Timeout)
+	defer cancel()
+	resultMap, err := findOne(ctx, projects, id)
+	if errors.Is(err, errNotFound) {
+		return notFoundPage("project", "Project Not Found"), err
+	}
+	if err != nil {
+		return ProductPage{}, err
 	}
-	return bsonData
+	return projectPage(resultMap)
 }
 
-// getProjectFromDatabase returns one project from the database as a ProductPage with a http status code if the project was found
-func getProjectFromDatabase(id string) (ProductPage, int) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+// getToolFromDatabase returns one tool from the database as a ProductPage
+// the tool and the projects using it are loaded in one round trip
+// if the tool does not exist, the returned page says so and the error wraps errNotFound
+func getToolFromDatabase(ctx context.Context, nameID string) (ProductPage, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Database.Timeout)
 	defer cancel()
-	database := getDatabase(ctx)
+	results, err := aggregate(ctx, software, toolPipeline(bson.M{"id": nameID}))
+	if err != nil {
+		return ProductPage{}, err
+	}
+	if len(results) == 0 {
+		return notFoundPage("tool", "Tool Not Found"), fmt.Errorf("%w: %s %s", errNotFound, software, nameID)
+	}
+	return toolPage(results[0])
+}
 
-	myProjects := database.Collection("projects")
+// product is a project or tool page of the static build with the id it is saved under
+type product struct {
+	ID   string
+	Page ProductPage
+}
 
-	result := myProjects.FindOne(ctx, bson.M{"id": id})
-	var resultMap bson.M
-	err := result.Decode(&resultMap)
-	if result.Err() != nil || err != nil {
-		log.Println("could not decode result: ", err)
-		return ProductPage{
-			Page: Page{
-				Title: "Project Not Found",
-				HTML:  getHTML(),
+// getAllProductPages returns the pages of all projects or all tools, loaded with one cursor
+func getAllProductPages(ctx context.Context, category string) ([]product, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Database.Timeout)
+	defer cancel()
+	var results []bson.M
+	var err error
+	page := projectPage
+	if category == software {
+		results, err = aggregate(ctx, software, toolPipeline(bson.M{}))
+		page = toolPage
+	} else {
+		results, err = findAll(ctx, category, bson.M{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	products := make([]product, 0, len(results))
+	for _, result := range results {
+		id, ok := result["id"].(string)
+		if !ok {
+			return nil, fmt.Errorf("an entry of %s has no id", category)
+		}
+		p, err := page(result)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, product{ID: id, Page: p})
+	}
+	return products, nil
+}
+
+// toolPipeline returns the aggregation of the tools matching the filter with the projects using them in the field projects
+// the projects of a tool are sorted by their database id, so they keep the order of the import
+func toolPipeline(filter bson.M) mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": projects,
+			"let":  bson.M{"tool": "$id"},
+			"pipeline": mongo.Pipeline{
+				// like a query on software.id, the field is a list of tools or a single tool
+				{{Key: "$match", Value: bson.M{"$expr": bson.M{"$in": bson.A{"$$tool", bson.M{"$cond": bson.A{
+					bson.M{"$isArray": "$software.id"}, "$software.id", bson.A{"$software.id"},
+				}}}}}}},
+				{{Key: "$sort", Value: bson.M{"_id": 1}}},
 			},
-			Type:      "project",
-			Noproduct: true,
-		}, http.StatusNotFound
+			"as": "projects",
+		}}},
 	}
+}
+
+// projectPage returns the ProductPage of a project document
+func projectPage(resultMap bson.M) (ProductPage, error) {
 	// TableContent is a map of all skills used in the project
+	var err error
 	tablemap := make(map[string][]bson.M)
-	tablemap["Software"] = getTableContent(resultMap, software)
-	tablemap["Skills"] = getTableContent(resultMap, "skills")
+	tablemap["Software"], err = getTableContent(resultMap, software)
+	if err != nil {
+		return ProductPage{}, err
+	}
+	tablemap["Skills"], err = getTableContent(resultMap, "skills")
+	if err != nil {
+		return ProductPage{}, err
+	}
 	return ProductPage{
 		Page: Page{
-			Title: resultMap["name"].(string),
+			Title: stringField(resultMap, "name"),
 			CSS:   "productpage",
 			HTML:  getHTML(),
 		},
-		Image:       resultMap["img"].(string),
-		Description: resultMap["long"].(string),
+		Image:       stringField(resultMap, "img"),
+		Description: stringField(resultMap, "long"),
 		Table:       tablemap,
 		Type:        "project",
-	}, http.StatusOK
+	}, nil
 }
 
-// getToolFromDatabase returns one tool from the database as a ProductPage with a http status code if the tool was found
-func getToolFromDatabase(nameID string) (ProductPage, int) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	database := getDatabase(ctx)
-
-	myProjects := database.Collection(software)
-
-	result := myProjects.FindOne(ctx, bson.M{"id": nameID})
-	var resultMap bson.M
-	err := result.Decode(&resultMap)
-	if result.Err() != nil || err != nil {
-		log.Println("could not decode result: ", err)
-		return ProductPage{
-			Page: Page{
-				Title: "Tool Not Found",
-				HTML:  getHTML(),
-			},
-			Type:      "tool",
-			Noproduct: true,
-		}, http.StatusNotFound
-	}
-
+// toolPage returns the ProductPage of a tool document of the toolPipeline
+func toolPage(resultMap bson.M) (ProductPage, error) {
 	// TableContent is a map of all information about the tool
+	var err error
 	tablemap := make(map[string][]bson.M)
-	tablemap["Company"] = []bson.M{{"name": resultMap["company"].(string)}}
-	tablemap["Projects"] = getProjectsFromSoftware(nameID)
+	tablemap["Company"] = []bson.M{{"name": stringField(resultMap, "company")}}
+	tablemap["Projects"], err = getTableContent(resultMap, "projects")
+	if err != nil {
+		return ProductPage{}, err
+	}
 	return ProductPage{
 		Page: Page{
-			Title: resultMap["name"].(string),
+			Title: stringField(resultMap, "name"),
 			CSS:   "productpage",
 			HTML:  getHTML(),
 		},
-		Image:       resultMap["img"].(string),
-		Description: resultMap["description"].(string),
+		Image:       stringField(resultMap, "img"),
+		Description: stringField(resultMap, "description"),
 		Table:       tablemap,
-		External:    resultMap["externallink"].(string),
+		External:    stringField(resultMap, "externallink"),
 		Type:        "tool",
-	}, http.StatusOK
+	}, nil
 }
 
-// getProjectsFromSoftware returns all projects that use a specific tool
-func getProjectsFromSoftware(id string) []bson.M {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	database := getDatabase(ctx)
-	myProjects := database.Collection(projects)
-	cursor, err := myProjects.Find(ctx, bson.M{"software.id": id})
+// notFoundPage returns the ProductPage shown for a project or tool that does not exist
+func notFoundPage(productType string, title string) ProductPage {
+	return ProductPage{
+		Page: Page{
+			Title: title,
+			HTML:  getHTML(),
+		},
+		Type:      productType,
+		Noproduct: true,
+	}
+}
+
+// findOne returns the entry with the given id of a collection, the error wraps errNotFound if there is none
+func findOne(ctx context.Context, collection string, id string) (bson.M, error) {
+	database, err := getDatabase(ctx)
 	if err != nil {
-		log.Println("could not find projects: ", err)
+		return nil, err
 	}
-	var results []bson.M
-	// iterate over all projects to change link to project
-	for cursor.Next(ctx) {
-		var result bson.M
-		err := cursor.Decode(&result)
-		if err != nil {
-			log.Println("could not decode result: ", err)
-		}
-		result["link"] = "project/" + result["id"].(string)
-		results = append(results, result)
+	var resultMap bson.M
+	err = database.Collection(collection).FindOne(ctx, bson.M{"id": id}).Decode(&resultMap)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("%w: %s %s", errNotFound, collection, id)
 	}
 	if err != nil {
-		log.Println("could not decode results: ", err)
+		return nil, fmt.Errorf("could not find %s %s: %w", collection, id, err)
 	}
-	return results
+	return resultMap, nil
 }
 
 // getTableContent returns all content that is shown in the table of a product page
-func getTableContent(resultMap bson.M, category string) []bson.M {
+func getTableContent(resultMap bson.M, category string) ([]bson.M, error) {
 	var tableContent []bson.M
-	for _, content := range resultMap[category].(bson.A) {
-		content := content.(bson.M)
-		// if the category is software, the link is changed to the tool page
+	list, ok := resultMap[category].(bson.A)
+	if !ok && resultMap[category] != nil {
+		return nil, fmt.Errorf("field %s of %s is not a list", category, stringField(resultMap, "id"))
+	}
+	for _, content := range list {
+		content, ok := content.(bson.M)
+		if !ok {
+			return nil, fmt.Errorf("field %s of %s contains an entry that is not an object", category, stringField(resultMap, "id"))
+		}
+		// the links of the table lead to the tool or project pages
 		if category == software {
-			content["link"] = "tool/" + content["id"].(string)
+			content["link"] = "tool/" + stringField(content, "id")
+		} else if category == projects {
+			content["link"] = "project/" + stringField(content, "id")
 		}
 		tableContent = append(tableContent, content)
 	}
-	return tableContent
+	return tableContent, nil
 }
 
-// getAllProjectsOfCollection returns all projects in the database from a specific collection as mongo cursor
-func getAllProjectsOfCollection(collection string) (*mongo.Cursor, context.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	database := getDatabase(ctx)
-	myProjects := database.Collection(collection)
-	result, err := myProjects.Find(ctx, bson.M{})
+// findAll returns all entries of a collection that match the filter
+func findAll(ctx context.Context, collection string, filter bson.M) ([]bson.M, error) {
+	database, err := getDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// sorted by the database id, so the entries keep the order of the import
+	cursor, err := database.Collection(collection).Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("could not find %s: %w", collection, err)
+	}
+	var results []bson.M
+	err = cursor.All(ctx, &results)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode %s: %w", collection, err)
+	}
+	return results, nil
+}
+
+// aggregate runs an aggregation pipeline on a collection and returns all results
+func aggregate(ctx context.Context, collection string, pipeline mongo.Pipeline) ([]bson.M, error) {
+	database, err := getDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := database.Collection(collection).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("could not aggregate %s: %w", collection, err)
+	}
+	var results []bson.M
+	err = cursor.All(ctx, &results)
 	if err != nil {
-		log.Fatalf("could not find %s: %v \n", collection, err)
+		return nil, fmt.Errorf("could not decode %s: %w", collection, err)
 	}
-	return result, ctx
+	return results, nil
+}
+
+// getAllProjectsOfCollection returns all entries of a specific collection
+func getAllProjectsOfCollection(ctx context.Context, collection string) ([]bson.M, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Database.Timeout)
+	defer cancel()
+	return findAll(ctx, collection, bson.M{})
+}
+
+// categoryPipeline groups the projects by the names of their categories,
+// projects without categories are put in the category other, projects with an empty list of categories are left out
+// the projects are sorted by their database id first, so every category keeps the order of the import
+var categoryPipeline = mongo.Pipeline{
+	{{Key: "$match", Value: bson.M{"categories": bson.M{"$ne": bson.A{}}}}},
+	{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	{{Key: "$addFields", Value: bson.M{"category": "$categories"}}},
+	{{Key: "$unwind", Value: bson.M{"path": "$category", "preserveNullAndEmptyArrays": true}}},
+	{{Key: "$group", Value: bson.M{
+		"_id":      bson.M{"$ifNull": bson.A{"$category.name", "other"}},
+		"projects": bson.M{"$push": "$$ROOT"},
+	}}},
 }
 
 // getAllProjects returns all projects in the database as a map of their categories in a bson.M object
-func getAllProjectsInCategories() map[string][]bson.M {
-	result, _ := getAllProjectsOfCollection(projects)
+func getAllProjectsInCategories(ctx context.Context) (map[string][]bson.M, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Database.Timeout)
+	defer cancel()
+	groups, err := aggregate(ctx, projects, categoryPipeline)
+	if err != nil {
+		return nil, err
+	}
 	categories := make(map[string][]bson.M)
-	for result.Next(context.TODO()) {
-		var project bson.M
-		err := result.Decode(&project)
-		if err != nil {
-			log.Fatalln("could not decode project: ", err)
-		}
-		if project["categories"] != nil {
-			//change project date from Y-M-D to YYYY
-			project["date"] = project["date"].(string)[:4]
-			//check if image file exists
-			project["img"] = checkImage(project["img"].(string))
-			// put project in the right category
-			for _, category := range project["categories"].(bson.A) {
-				name := category.(bson.M)["name"].(string)
-				categories[name] = append(categories[name], project)
+	for _, group := range groups {
+		name := fmt.Sprint(group["_id"])
+		list, _ := group["projects"].(bson.A)
+		for _, project := range list {
+			project, ok := project.(bson.M)
+			if !ok {
+				continue
 			}
-		} else {
-			categories["other"] = append(categories["other"], project)
+			if project["category"] != nil {
+				//change project date from Y-M-D to YYYY
+				if date := stringField(project, "date"); len(date) >= 4 {
+					project["date"] = date[:4]
+				}
+				//check if image file exists
+				project["img"] = checkImage(ctx, stringField(project, "img"))
+				delete(project, "category")
+			}
+			categories[name] = append(categories[name], project)
 		}
 	}
-	return categories
+	return categories, nil
 }
 
-// getAllIDs returns all database nameIDs of a category projects as a string array
-func getAllIDs(category string) []string {
-	result, _ := getAllProjectsOfCollection(category)
-	var ids []string
-	for result.Next(context.TODO()) {
-		var content bson.M
-		err := result.Decode(&content)
-		if err != nil {
-			log.Fatal("could not decode content: ", err)
-		}
-		ids = append(ids, content["id"].(string))
-	}
-	return ids
+// stringField returns a string field of an entry or "" if it is missing or not a string
+func stringField(m bson.M, key string) string {
+	value, _ := m[key].(string)
+	return value
 }
 
 // checkImage checks if an image file exists and returns the path to the image or a default image
-func checkImage(imagePath string) string {
+// the image is looked up in the images of the context, see withImages
+func checkImage(ctx context.Context, imagePath string) string {
 	// lores image is the image specially made for the home page
-	imagepath := "./static/images/lores/" + imagePath
-	if _, err := os.Stat(imagepath); os.IsNotExist(err) {
+	imagepath := "static/images/lores/" + imagePath
+	images := imageFiles(ctx)
+	if _, err := fs.Stat(images, "images/lores/"+imagePath); errors.Is(err, fs.ErrNotExist) {
 		// if the lores image does not exist, the normal image is used which is maybe too big for the home page
-		imagepath = "./static/images/hires/" + imagePath
-		if _, err := os.Stat(imagepath); os.IsNotExist(err) {
+		imagepath = "static/images/hires/" + imagePath
+		if _, err := fs.Stat(images, "images/hires/"+imagePath); errors.Is(err, fs.ErrNotExist) {
 			// if the normal image does not exist, a default image is used
-			imagepath = "./static/images/lores/coming-soon.png"
+			imagepath = "static/images/lores/coming-soon.png"
 		}
 	}
 	return imagepath
 }
 
 // getEductionFromDatabase returns all education from the database as a slice of bson.M objects
-func getEducationFromDatabase() []bson.M {
-	return getSkillFromDatabase(education)
+func getEducationFromDatabase(ctx context.Context) ([]bson.M, error) {
+	return getSkillFromDatabase(ctx, education)
 }
 
 // getProgLangFromDatabase returns all programming languages from the database as a slice of bson.M objects
-func getProgLangFromDatabase() []bson.M {
-	return getSkillFromDatabase(proglanguage)
+func getProgLangFromDatabase(ctx context.Context) ([]bson.M, error) {
+	return getSkillFromDatabase(ctx, proglanguage)
 }
 
 // getSoftwareFromDatabase returns all software from the database as a slice of bson.M objects
-func getSoftwareFromDatabase() []bson.M {
-	return getSkillFromDatabase(software)
+func getSoftwareFromDatabase(ctx context.Context) ([]bson.M, error) {
+	return getSkillFromDatabase(ctx, software)
 }
 
 // getOtherSkillsFromDatabase returns all other skills from the database as a slice of bson.M objects
-func getOtherSkillsFromDatabase() []bson.M {
-	return getSkillFromDatabase(otherskills)
+func getOtherSkillsFromDatabase(ctx context.Context) ([]bson.M, error) {
+	return getSkillFromDatabase(ctx, otherskills)
 }
 
 // getLanguageFromDatabase returns all languages from the database as a slice of bson.M objects
-func getLanguageFromDatabase() []bson.M {
-	return getSkillFromDatabase(language)
+func getLanguageFromDatabase(ctx context.Context) ([]bson.M, error) {
+	return getSkillFromDatabase(ctx, language)
 }
 
 // getSkillFromDatabase returns all skills from a specific category from the database as a slice of bson.M objects
-func getSkillFromDatabase(col string) []bson.M {
-	result, ctx := getAllProjectsOfCollection(col)
-	var content []bson.M
-	err := result.All(ctx, &content)
-	if err != nil {
-		log.Fatalf("could not decode results: %v", err)
-	}
-	return content
+func getSkillFromDatabase(ctx context.Context, col string) ([]bson.M, error) {
+	return getAllProjectsOfCollection(ctx, col)
 }
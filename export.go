@@ -0,0 +1,106 @@
+/*
+ This file contains the export of the database as zip file.
+ The zip file has the same layout as the resources.zip in the input folder,
+ so it can be imported again.
+*/
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// exportZip writes every collection as json file and all images of the static folder to a zip file
+func exportZip(path string) error {
+	err := waitForDatabase()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := zip.NewWriter(f)
+
+	err = exportCollections(w)
+	if err == nil {
+		err = exportImages(w)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return err
+	}
+	appLog.Info("exported database", "file", path)
+	return f.Close()
+}
+
+// exportCollections writes every collection of the database as json file to the zip file
+func exportCollections(w *zip.Writer) error {
+	for _, collection := range collections {
+		docs, err := exportCollection(context.Background(), collection)
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(docs, "", "  ")
+		if err != nil {
+			return err
+		}
+		fw, err := w.Create("json/" + collection + ".json")
+		if err != nil {
+			return err
+		}
+		_, err = fw.Write(data)
+		if err != nil {
+			return err
+		}
+		appLog.Info("exported collection", "collection", collection, "count", len(docs))
+	}
+	return nil
+}
+
+// exportImages writes all images of the static folder to the zip file
+func exportImages(w *zip.Writer) error {
+	dir := filepath.Join(cfg.Paths.Static, "images")
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(cfg.Paths.Static, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if d.IsDir() {
+			_, err = w.Create(name + "/")
+			return err
+		}
+		fw, err := w.Create(name)
+		if err != nil {
+			return err
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer func(in *os.File) {
+			err := in.Close()
+			if err != nil {
+				return
+			}
+		}(in)
+		_, err = io.Copy(fw, in)
+		return err
+	})
+}
@@ -0,0 +1,290 @@
+/*
+ This file contains the fingerprinting and minification of the static files.
+ Every static file except the imported images is minified and gets the hash of its content in its name,
+ e.g. styles/home.css becomes styles/home.1a2b3c4d.css, so it can be cached by browsers forever.
+ The templates link to the files with the asset function, which returns the fingerprinted URL,
+ and the web server serves the same files the static build writes.
+ References with url() in stylesheets are rewritten to the fingerprinted names as well.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/css"
+	"github.com/tdewolff/minify/v2/html"
+	"github.com/tdewolff/minify/v2/js"
+	"github.com/tdewolff/minify/v2/svg"
+	"html/template"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cssURLPattern matches the url() references of a stylesheet
+var cssURLPattern = regexp.MustCompile(`url\(\s*(['"]?)([^'")]+)(['"]?)\s*\)`)
+
+// minifiers maps the media types that are minified to their minifier
+var minifiers = minify.New()
+
+func init() {
+	minifiers.AddFunc("text/css", css.Minify)
+	minifiers.AddFunc("application/javascript", js.Minify)
+	minifiers.AddFunc("image/svg+xml", svg.Minify)
+	// the document tags, end tags and quotes are kept, so the pages stay easy to read and check
+	minifiers.Add("text/html", &html.Minifier{KeepDocumentTags: true, KeepEndTags: true, KeepQuotes: true})
+}
+
+var (
+	// currentAssets are the prepared static files used by the asset function and the web server
+	currentAssets *assetIndex
+	assetsMux     sync.RWMutex
+)
+
+// assetFile is a static file prepared for the web server and the static build
+type assetFile struct {
+	// name is the path in the static folder, url the fingerprinted path in the static folder
+	name    string
+	url     string
+	content []byte
+	// variants are the compressed contents the web server sends
+	variants compressedVariants
+	etag     string
+}
+
+// assetIndex contains the prepared static files by their name and by their fingerprinted path
+type assetIndex struct {
+	byName  map[string]*assetFile
+	byURL   map[string]*assetFile
+	modTime time.Time
+}
+
+// setAssets sets the prepared static files used by the asset function and the web server
+func setAssets(index *assetIndex) {
+	assetsMux.Lock()
+	defer assetsMux.Unlock()
+	currentAssets = index
+}
+
+// getAssets returns the prepared static files, nil before they are loaded
+func getAssets() *assetIndex {
+	assetsMux.RLock()
+	defer assetsMux.RUnlock()
+	return currentAssets
+}
+
+// loadAssets prepares every static file of the file system except the images
+// stylesheets are prepared last, so their url() references can be rewritten to the fingerprinted names of the others
+func loadAssets(fsys fs.FS) (*assetIndex, error) {
+	index := &assetIndex{byName: make(map[string]*assetFile), byURL: make(map[string]*assetFile), modTime: time.Now()}
+	var names []string
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && isImagePath(name) {
+			return fs.SkipDir
+		}
+		// Skip directories and symlinks.
+		if d.IsDir() || d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return path.Ext(names[i]) != ".css" && path.Ext(names[j]) == ".css"
+	})
+	for _, name := range names {
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		if path.Ext(name) == ".css" {
+			content = index.rewriteCSSURLs(name, content)
+		}
+		content, err = minifyAsset(name, content)
+		if err != nil {
+			return nil, fmt.Errorf("could not minify %s: %w", name, err)
+		}
+		file := &assetFile{name: name, url: fingerprint(name, content), content: content, etag: contentETag(content)}
+		index.byName[name] = file
+		index.byURL[file.url] = file
+	}
+	return index, nil
+}
+
+// fingerprint returns the name with the first 8 hex digits of the SHA-256 of the content before the extension
+// without cfg.Build.Fingerprint the name stays as it is
+func fingerprint(name string, content []byte) string {
+	if !cfg.Build.Fingerprint {
+		return name
+	}
+	sum := sha256.Sum256(content)
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum[:4]) + ext
+}
+
+// minifyAsset minifies the content of a static file if cfg.Build.Minify is set and its type has a minifier
+func minifyAsset(name string, content []byte) ([]byte, error) {
+	mediaType := strings.SplitN(mime.TypeByExtension(path.Ext(name)), ";", 2)[0]
+	if mediaType == "text/javascript" {
+		mediaType = "application/javascript"
+	}
+	return minifyContent(mediaType, content)
+}
+
+// minifyContent minifies content of the media type if cfg.Build.Minify is set, other media types are returned unchanged
+func minifyContent(mediaType string, content []byte) ([]byte, error) {
+	if !cfg.Build.Minify {
+		return content, nil
+	}
+	_, _, fn := minifiers.Match(mediaType)
+	if fn == nil {
+		return content, nil
+	}
+	return minifiers.Bytes(mediaType, content)
+}
+
+// rewriteCSSURLs replaces the url() references of a stylesheet to prepared files with their fingerprinted names
+func (index *assetIndex) rewriteCSSURLs(name string, content []byte) []byte {
+	return cssURLPattern.ReplaceAllFunc(content, func(match []byte) []byte {
+		parts := cssURLPattern.FindSubmatch(match)
+		ref := string(parts[2])
+		if strings.Contains(ref, ":") || strings.HasPrefix(ref, "/") || strings.HasPrefix(ref, "#") {
+			return match
+		}
+		rest := ""
+		if i := strings.IndexAny(ref, "?#"); i >= 0 {
+			ref, rest = ref[:i], ref[i:]
+		}
+		file, ok := index.byName[path.Join(path.Dir(name), ref)]
+		if !ok {
+			return match
+		}
+		rewritten := path.Join(path.Dir(ref), path.Base(file.url)) + rest
+		return []byte("url(" + string(parts[1]) + rewritten + string(parts[3]) + ")")
+	})
+}
+
+// signature returns a hash of the names and fingerprinted paths of all files,
+// pages that link to the files change whenever it changes
+func (index *assetIndex) signature() string {
+	names := make([]string, 0, len(index.byName))
+	for name, file := range index.byName {
+		names = append(names, name+"\x00"+file.url)
+	}
+	sort.Strings(names)
+	sum := sha256.Sum256([]byte(strings.Join(names, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// assetURL returns the URL of a static file, fingerprinted if the file is prepared
+// it is the asset function of the templates, e.g. {{ asset "styles/home.css" }}
+func assetURL(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if index := getAssets(); index != nil {
+		if file, ok := index.byName[name]; ok {
+			return basePath() + "/static/" + file.url
+		}
+	}
+	return basePath() + "/static/" + name
+}
+
+// siteURL returns the path of a page or file under the base path, the parts are joined without separator
+// it is the url function of the templates, e.g. {{ url "project/" .id }}
+func siteURL(parts ...interface{}) string {
+	return joinURL(basePath(), parts...)
+}
+
+// joinURL returns the path of a page or file under the root path, the parts are joined without separator
+func joinURL(root string, parts ...interface{}) string {
+	var b strings.Builder
+	for _, part := range parts {
+		b.WriteString(fmt.Sprint(part))
+	}
+	return root + "/" + strings.TrimPrefix(b.String(), "/")
+}
+
+// templateFuncs returns the functions the templates can use
+func templateFuncs() template.FuncMap {
+	return template.FuncMap{"asset": assetURL, "url": siteURL}
+}
+
+// reloadAssets prepares the static files again, it is called when they change in watch mode
+func reloadAssets() error {
+	static, err := staticFS()
+	if err != nil {
+		return err
+	}
+	index, err := loadAssets(static)
+	if err != nil {
+		return err
+	}
+	if cfg.Server.Compress {
+		for _, file := range index.byName {
+			file.variants = compressVariants(mime.TypeByExtension(path.Ext(file.name)), file.content, true)
+		}
+	}
+	setAssets(index)
+	return nil
+}
+
+// assetHandler serves the prepared static files, fingerprinted ones with the cache policy of assets that lets browsers cache them forever
+// all other files, like the images and the files under their original names, are served from the file system
+// every file has an ETag of its content, so requests with If-None-Match or If-Modified-Since are answered with 304 while it is unchanged
+func assetHandler(fsys fs.FS) gin.HandlerFunc {
+	files := http.FileServer(filesOnly{http.FS(fsys)})
+	return func(c *gin.Context) {
+		name := strings.TrimPrefix(c.Param("filepath"), "/")
+		if index := getAssets(); index != nil {
+			if file, ok := index.byURL[name]; ok {
+				if file.url != file.name {
+					setCacheControl(c, cfg.Cache.Assets)
+				} else {
+					setCacheControl(c, cfg.Cache.HTML)
+				}
+				content := file.content
+				encoding := ""
+				// parts of a file are taken from the uncompressed content
+				if c.GetHeader("Range") == "" {
+					encoding, content = file.variants.pick(c, file.content)
+				} else if file.variants != nil {
+					addVary(c.Writer.Header())
+				}
+				// http.ServeContent answers conditional requests with this ETag
+				c.Header("ETag", encodedETag(file.etag, encoding))
+				http.ServeContent(c.Writer, c.Request, path.Base(file.url), index.modTime, bytes.NewReader(content))
+				return
+			}
+		}
+		etag, err := fileETagOf(fsys, name)
+		if err != nil {
+			pageNotFound(c)
+			return
+		}
+		if isImagePath(name) {
+			setCacheControl(c, cfg.Cache.Images)
+		} else {
+			setCacheControl(c, cfg.Cache.HTML)
+		}
+		c.Header("ETag", etag)
+		// the file server looks the file up by the path of the request, the route decides where the static folder is mounted
+		c.Request.URL.Path = "/" + name
+		c.Request.URL.RawPath = ""
+		files.ServeHTTP(c.Writer, c.Request)
+	}
+}
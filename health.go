@@ -0,0 +1,43 @@
+/*
+ This file contains the health endpoints for Docker and orchestrators.
+ /healthz only reports that the process is alive,
+ /readyz reports that the database is reachable and the content is imported, so pages can be served.
+*/
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+const (
+	healthPath = "/healthz"
+	readyPath  = "/readyz"
+)
+
+// setupHealthRoutes adds the liveness and readiness endpoints to the router
+func setupHealthRoutes(router gin.IRouter) {
+	router.GET(healthPath, healthHandler)
+	router.GET(readyPath, readyHandler)
+}
+
+// healthHandler answers as long as the web server runs, it never touches the database
+func healthHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// readyHandler answers with 200 if the database is reachable and the content is imported and with 503 otherwise
+func readyHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(dataContext(c), cfg.Database.Timeout)
+	defer cancel()
+	err := pingDatabase(ctx)
+	if err == nil {
+		err = checkImported(ctx)
+	}
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
@@ -0,0 +1,132 @@
+/*
+ This file contains the HTTP caching of the web server.
+ Every response gets the Cache-Control of its class: pages, fingerprinted static files or images.
+ Pages carry the hash of their body as ETag and the time of the last import as Last-Modified,
+ static files the hash of their content and their modification time,
+ so browsers and proxies can revalidate them and are answered with 304 while nothing changed.
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// contentModified is the time the data or the templates of the pages last changed
+	contentModified    = time.Now()
+	contentModifiedMux sync.RWMutex
+)
+
+var (
+	// fileETags are the ETags of the files served from the file system by their name
+	fileETags    = make(map[string]fileETag)
+	fileETagsMux sync.Mutex
+)
+
+// fileETag is the ETag of a file and the size and modification time it was computed for
+type fileETag struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+// markContentModified records that the data or the templates of the pages changed
+func markContentModified() {
+	contentModifiedMux.Lock()
+	defer contentModifiedMux.Unlock()
+	contentModified = time.Now()
+}
+
+// getContentModified returns the time the data or the templates of the pages last changed
+func getContentModified() time.Time {
+	contentModifiedMux.RLock()
+	defer contentModifiedMux.RUnlock()
+	return contentModified
+}
+
+// contentETag returns a strong ETag of content
+func contentETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// encodedETag returns the ETag of the variant of a body in an encoding, every encoding has its own ETag as the bodies differ
+func encodedETag(etag string, encoding string) string {
+	if encoding == "" {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// setCacheControl sets the Cache-Control header unless a handler before already set one, an empty policy sets none
+func setCacheControl(c *gin.Context, policy string) {
+	if policy != "" && c.Writer.Header().Get("Cache-Control") == "" {
+		c.Header("Cache-Control", policy)
+	}
+}
+
+// notModified reports if a GET or HEAD request can be answered with 304 for a response with the ETag and modification time
+// If-None-Match takes precedence over If-Modified-Since as RFC 9110 demands, a zero time never matches
+func notModified(c *gin.Context, etag string, modTime time.Time) bool {
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		return false
+	}
+	if header := c.GetHeader("If-None-Match"); header != "" {
+		return etagMatches(header, etag)
+	}
+	since, err := http.ParseTime(c.GetHeader("If-Modified-Since"))
+	if err != nil || modTime.IsZero() {
+		return false
+	}
+	// HTTP dates have no fractions of seconds
+	return !modTime.Truncate(time.Second).After(since)
+}
+
+// etagMatches reports if the If-None-Match header contains the ETag, weak ETags match their strong form
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// fileETagOf returns the ETag of a file of the file system from the hash of its content
+// the hash is computed once for every size and modification time of the file
+func fileETagOf(fsys fs.FS, name string) (string, error) {
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return "", err
+	}
+	fileETagsMux.Lock()
+	cached, ok := fileETags[name]
+	fileETagsMux.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.etag, nil
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	etag := `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+	fileETagsMux.Lock()
+	fileETags[name] = fileETag{size: info.Size(), modTime: info.ModTime(), etag: etag}
+	fileETagsMux.Unlock()
+	return etag, nil
+}
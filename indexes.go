@@ -0,0 +1,79 @@
+/*
+ This file contains the indexes of the collections, they are created by the import before the entries are inserted.
+ The ids of projects and tools are unique, so an import with duplicate ids fails instead of hiding entries.
+ The other indexes serve the lookups of the product pages, the category grouping and the text search.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sort"
+	"strings"
+)
+
+// errDuplicateID is returned by the import if two entries of a collection have the same id
+var errDuplicateID = errors.New("duplicate id")
+
+// collectionIndexes lists the indexes of every collection that has any
+var collectionIndexes = map[string][]mongo.IndexModel{
+	projects: {
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetName("id_unique").SetUnique(true)},
+		{Keys: bson.D{{Key: "software.id", Value: 1}}, Options: options.Index().SetName("software_id")},
+		{Keys: bson.D{{Key: "categories.name", Value: 1}}, Options: options.Index().SetName("categories_name")},
+		{Keys: bson.D{{Key: "date", Value: -1}}, Options: options.Index().SetName("date")},
+		{Keys: bson.D{{Key: "name", Value: "text"}, {Key: "long", Value: "text"}},
+			Options: options.Index().SetName("search").SetWeights(bson.M{"name": 10, "long": 1})},
+	},
+	software: {
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetName("id_unique").SetUnique(true)},
+		{Keys: bson.D{{Key: "name", Value: "text"}, {Key: "description", Value: "text"}, {Key: "company", Value: "text"}},
+			Options: options.Index().SetName("search").SetWeights(bson.M{"name": 10, "description": 1, "company": 1})},
+	},
+}
+
+// createIndexes creates the indexes of a collection
+func createIndexes(ctx context.Context, collection *mongo.Collection) error {
+	models, ok := collectionIndexes[collection.Name()]
+	if !ok {
+		return nil
+	}
+	_, err := collection.Indexes().CreateMany(ctx, models)
+	if err != nil {
+		return fmt.Errorf("could not create indexes: %w", err)
+	}
+	return nil
+}
+
+// checkDuplicateIDs returns an error naming every id that is used by more than one entry
+// it only checks collections with a unique index on the id
+func checkDuplicateIDs(collection string, content bson.A) error {
+	if _, ok := collectionIndexes[collection]; !ok {
+		return nil
+	}
+	positions := make(map[string][]string)
+	for i, entry := range content {
+		entry, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if id, ok := entry["id"].(string); ok {
+			positions[id] = append(positions[id], fmt.Sprint(i))
+		}
+	}
+	var duplicates []string
+	for id, list := range positions {
+		if len(list) > 1 {
+			duplicates = append(duplicates, fmt.Sprintf("%q (entries %s)", id, strings.Join(list, ", ")))
+		}
+	}
+	if len(duplicates) == 0 {
+		return nil
+	}
+	sort.Strings(duplicates)
+	return fmt.Errorf("%w in %s.json: %s", errDuplicateID, collection, strings.Join(duplicates, "; "))
+}
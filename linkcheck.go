@@ -0,0 +1,328 @@
+/*
+ This file contains the link checker of the website.
+ It crawls the static build or a running server from the home page, follows every internal link to a page
+ and checks that every linked page, image, stylesheet and script exists, including the url() references of stylesheets.
+ In the static build it also reports orphan pages, pages that no other page links to.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tdewolff/parse/v2"
+	"github.com/tdewolff/parse/v2/html"
+	stdhtml "html"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// checkTimeout is the time a running server has to answer a request of the link checker
+const checkTimeout = 30 * time.Second
+
+// maxCheckedBody is the largest page or stylesheet the link checker reads from a running server
+const maxCheckedBody = 10 << 20
+
+// errLinksBroken is returned when the link checker found problems
+var errLinksBroken = errors.New("broken links found")
+
+// fetchFunc returns the status and media type of a path of the site and the content of pages and stylesheets
+type fetchFunc func(ctx context.Context, p string) (status int, mediaType string, content []byte, err error)
+
+// siteLink is a link from a page or stylesheet to a path of the site
+type siteLink struct {
+	from   string
+	target string
+	// kind is link, image, stylesheet, script or file
+	kind string
+}
+
+// linkProblem is a broken link or an orphan page
+type linkProblem struct {
+	kind   string
+	target string
+	// from is the page that links to the target, "" for orphan pages
+	from   string
+	reason string
+}
+
+// linkReport is the result of the link checker
+type linkReport struct {
+	checked  int
+	pages    int
+	problems []linkProblem
+}
+
+// checkBuild checks the links of the static build in the buildDir
+func checkBuild(ctx context.Context) (linkReport, error) {
+	host := ""
+	if u, err := url.Parse(cfg.BaseURL); err == nil {
+		host = u.Host
+	}
+	report, pages, err := checkLinks(ctx, dirFetcher(buildDir()), basePath()+"/", host)
+	if err != nil {
+		return report, err
+	}
+	// pages the crawl did not reach are orphans
+	reached := make(map[string]bool, len(pages))
+	for _, p := range pages {
+		if name, ok := buildFileName(buildDir(), p); ok {
+			reached[name] = true
+		}
+	}
+	err = filepath.WalkDir(buildDir(), func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || path.Ext(name) != ".html" {
+			return err
+		}
+		rel, err := filepath.Rel(buildDir(), name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !reached[rel] {
+			report.problems = append(report.problems, linkProblem{kind: "page", target: basePath() + "/" + rel, reason: "orphan"})
+		}
+		return nil
+	})
+	sortProblems(report.problems)
+	return report, err
+}
+
+// checkServer checks the links of a running server, starting at the page of the URL
+func checkServer(ctx context.Context, rawURL string) (linkReport, error) {
+	start, err := url.Parse(rawURL)
+	if err != nil || (start.Scheme != "http" && start.Scheme != "https") || start.Host == "" {
+		return linkReport{}, fmt.Errorf("invalid server URL %q", rawURL)
+	}
+	if start.Path == "" {
+		start.Path = "/"
+	}
+	report, _, err := checkLinks(ctx, httpFetcher(start), start.Path, start.Host)
+	sortProblems(report.problems)
+	return report, err
+}
+
+// checkLinks crawls the site from the start page and checks every internal link once
+// it returns the report and the paths of all pages it reached, links to other hosts are not checked
+func checkLinks(ctx context.Context, fetch fetchFunc, start string, host string) (linkReport, []string, error) {
+	var report linkReport
+	var links []siteLink
+	var pages []string
+	status := map[string]int{start: 0}
+	queue := []siteLink{{target: start, kind: "link"}}
+	for len(queue) > 0 {
+		link := queue[0]
+		queue = queue[1:]
+		code, mediaType, content, err := fetch(ctx, link.target)
+		if err != nil {
+			return report, nil, fmt.Errorf("could not check %s: %w", link.target, err)
+		}
+		status[link.target] = code
+		report.checked++
+		if code != http.StatusOK {
+			continue
+		}
+		var refs []siteLink
+		switch {
+		case mediaType == "text/html" && link.kind == "link":
+			report.pages++
+			pages = append(pages, link.target)
+			refs = htmlLinks(content)
+		case mediaType == "text/css":
+			refs = cssLinks(content)
+		}
+		for _, ref := range refs {
+			target, ok := internalPath(link.target, ref.target, host)
+			if !ok {
+				continue
+			}
+			links = append(links, siteLink{from: link.target, target: target, kind: ref.kind})
+			if _, seen := status[target]; !seen {
+				status[target] = 0
+				queue = append(queue, siteLink{target: target, kind: ref.kind})
+			}
+		}
+	}
+	if code := status[start]; code != http.StatusOK {
+		report.problems = append(report.problems, linkProblem{kind: "page", target: start, reason: http.StatusText(code)})
+	}
+	for _, link := range links {
+		if code := status[link.target]; code != http.StatusOK {
+			report.problems = append(report.problems, linkProblem{kind: link.kind, target: link.target, from: link.from, reason: http.StatusText(code)})
+		}
+	}
+	return report, pages, nil
+}
+
+// internalPath resolves a reference of a page and returns its path without query and fragment
+// references to other hosts, other schemes and the page itself are not internal
+func internalPath(page string, ref string, host string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil || strings.HasPrefix(ref, "#") || ref == "" {
+		return "", false
+	}
+	if u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" {
+		return "", false
+	}
+	if u.Host != "" && u.Host != host {
+		return "", false
+	}
+	resolved := (&url.URL{Path: page}).ResolveReference(&url.URL{Path: u.Path})
+	return resolved.Path, true
+}
+
+// htmlLinks returns the links, images, stylesheets and scripts of a page
+func htmlLinks(content []byte) []siteLink {
+	var links []siteLink
+	lexer := html.NewLexer(parse.NewInputBytes(content))
+	tag := ""
+	attrs := map[string]string{}
+	for {
+		tt, _ := lexer.Next()
+		switch tt {
+		case html.ErrorToken:
+			return links
+		case html.StartTagToken:
+			tag = strings.ToLower(string(lexer.Text()))
+			attrs = map[string]string{}
+		case html.AttributeToken:
+			value := strings.Trim(string(lexer.AttrVal()), `"'`)
+			attrs[strings.ToLower(string(lexer.Text()))] = stdhtml.UnescapeString(value)
+		case html.StartTagCloseToken, html.StartTagVoidToken:
+			if link, ok := elementLink(tag, attrs); ok {
+				links = append(links, link)
+			}
+			tag = ""
+		}
+	}
+}
+
+// elementLink returns the link of an element with its attributes, if it has one
+func elementLink(tag string, attrs map[string]string) (siteLink, bool) {
+	switch tag {
+	case "a":
+		return siteLink{target: attrs["href"], kind: "link"}, attrs["href"] != ""
+	case "link":
+		if strings.Contains(strings.ToLower(attrs["rel"]), "stylesheet") {
+			return siteLink{target: attrs["href"], kind: "stylesheet"}, attrs["href"] != ""
+		}
+		return siteLink{target: attrs["href"], kind: "file"}, attrs["href"] != ""
+	case "script":
+		return siteLink{target: attrs["src"], kind: "script"}, attrs["src"] != ""
+	case "img", "source":
+		return siteLink{target: attrs["src"], kind: "image"}, attrs["src"] != ""
+	}
+	return siteLink{}, false
+}
+
+// cssLinks returns the url() references of a stylesheet
+func cssLinks(content []byte) []siteLink {
+	var links []siteLink
+	for _, match := range cssURLPattern.FindAllSubmatch(content, -1) {
+		if ref := string(match[2]); !strings.HasPrefix(ref, "data:") {
+			links = append(links, siteLink{target: ref, kind: "image"})
+		}
+	}
+	return links
+}
+
+// buildFileName returns the file in the build folder a static web server answers a path with
+// folders are answered with their index.html and paths without extension with the .html file of the same name
+func buildFileName(root string, p string) (string, bool) {
+	if p != basePath() && !strings.HasPrefix(p, basePath()+"/") {
+		return "", false
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(p, basePath()), "/")
+	candidates := []string{name, path.Join(name, "index.html")}
+	if name == "" || strings.HasSuffix(name, "/") {
+		candidates = []string{path.Join(name, "index.html")}
+	} else if path.Ext(name) == "" {
+		candidates = append(candidates, name+".html")
+	}
+	for _, candidate := range candidates {
+		info, err := os.Stat(filepath.Join(root, filepath.FromSlash(candidate)))
+		if err == nil && !info.IsDir() {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// dirFetcher returns a fetchFunc that answers like a static web server with the files of a folder
+func dirFetcher(root string) fetchFunc {
+	return func(ctx context.Context, p string) (int, string, []byte, error) {
+		name, ok := buildFileName(root, p)
+		if !ok {
+			return http.StatusNotFound, "", nil, nil
+		}
+		mediaType := strings.SplitN(mime.TypeByExtension(path.Ext(name)), ";", 2)[0]
+		if mediaType != "text/html" && mediaType != "text/css" {
+			return http.StatusOK, mediaType, nil, nil
+		}
+		content, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		return http.StatusOK, mediaType, content, err
+	}
+}
+
+// httpFetcher returns a fetchFunc that requests the paths from the host of a server URL, following redirects
+func httpFetcher(server *url.URL) fetchFunc {
+	client := &http.Client{Timeout: checkTimeout}
+	return func(ctx context.Context, p string) (int, string, []byte, error) {
+		target := url.URL{Scheme: server.Scheme, Host: server.Host, Path: p}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+		if err != nil {
+			return 0, "", nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, "", nil, err
+		}
+		defer resp.Body.Close()
+		mediaType := strings.TrimSpace(strings.SplitN(resp.Header.Get("Content-Type"), ";", 2)[0])
+		if resp.StatusCode != http.StatusOK || (mediaType != "text/html" && mediaType != "text/css") {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			return resp.StatusCode, mediaType, nil, nil
+		}
+		content, err := io.ReadAll(io.LimitReader(resp.Body, maxCheckedBody))
+		return resp.StatusCode, mediaType, content, err
+	}
+}
+
+// sortProblems sorts the problems by target and page, so reports of the same site are the same
+func sortProblems(problems []linkProblem) {
+	sort.Slice(problems, func(i, j int) bool {
+		if problems[i].target != problems[j].target {
+			return problems[i].target < problems[j].target
+		}
+		return problems[i].from < problems[j].from
+	})
+}
+
+// print writes every problem and a summary
+func (r linkReport) print(w io.Writer) {
+	for _, p := range r.problems {
+		if p.from == "" {
+			fmt.Fprintf(w, "%s %s: %s\n", p.reason, p.kind, p.target)
+		} else {
+			fmt.Fprintf(w, "broken %s %s on %s: %s\n", p.kind, p.target, p.from, p.reason)
+		}
+	}
+	fmt.Fprintf(w, "%d pages, %d links checked, %d problems\n", r.pages, r.checked, len(r.problems))
+}
+
+// log logs every problem as warning and a summary
+func (r linkReport) log() {
+	for _, p := range r.problems {
+		appLog.Warn("link check", "problem", p.reason, "kind", p.kind, "target", p.target, "page", p.from)
+	}
+	appLog.Info("links checked", "pages", r.pages, "checked", r.checked, "problems", len(r.problems))
+}
@@ -1,5 +1,6 @@
 /*
  This application starts a web server or serves it as static pages.
+It is configured by a configuration file, environment variables and flags, see config.go.
 It uses a zip file with the json files and the static files.
 The zip file is loaded from the input folder and the static pages are saved to the output folder.
 The json files are saved to the json folder and then loaded into the database.
@@ -8,164 +9,240 @@ package main
 
 import (
 	"archive/zip"
+	"context"
+	"fmt"
 	"io"
-	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 )
 
-const (
-	statDir = "./static"
-	jsonDir = "./json"
-)
-
-var (
-	outputDir = "output"
-	buildDir  = outputDir + "/webapp_build"
-	// check if static build is requested
-	st       = os.Getenv("BUILD_STATIC") == "1"
-	inputDir = "input"
-)
-
-// main is the entry point for the application.
+// main is the entry point for the application, it runs the command given in the arguments, see cli.go
 func main() {
-	log.Println("Starting application")
+	os.Exit(run(os.Args[1:]))
+}
+
+// runAll runs every step: it imports the zip file and then builds the static pages or starts the web server
+// it is the command without a name, so the application works without arguments
+func runAll() error {
+	appLog.Info("starting application", "version", version)
 
-	checkInputFolder()
-	loadZip()
-	buildDatabase()
+	err := importZip(defaultZipPath())
+	if err != nil {
+		return err
+	}
 
 	// check if static build is requested and build static pages or start web server
-	if st {
-		static()
-	} else {
-		dynamic()
+	if cfg.Static {
+		return build(false)
+	}
+	return dynamic()
+}
+
+// importZip extracts the zip file and imports its json files into the database
+func importZip(path string) error {
+	if path == defaultZipPath() {
+		err := checkInputFolder()
+		if err != nil {
+			return err
+		}
+	}
+	err := loadZip(path)
+	if err != nil {
+		return err
 	}
+	return buildDatabase()
 }
 
 // checkInputFolder checks if input folder exists. It's needed for the zip file
-func checkInputFolder() {
-	log.Println("Input folder: ", inputDir)
+func checkInputFolder() error {
+	appLog.Info("input folder", "path", cfg.Paths.Input)
 	//print all input files
-	files, err := os.ReadDir(inputDir)
+	files, err := os.ReadDir(cfg.Paths.Input)
 	if err != nil {
-		log.Fatalln("Error reading input folder: ", err)
+		return fmt.Errorf("error reading input folder: %w", err)
 	}
 	for _, f := range files {
-		log.Println("Input file: ", f.Name())
+		appLog.Debug("input file", "name", f.Name())
 	}
+	return nil
 }
 
-// loadZip loads the zip file from the input folder and extracts the json files to the json folder
-func loadZip() {
-	var zipName string
+// defaultZipPath returns the path of the zip file in the input folder
+func defaultZipPath() string {
+	return cfg.Paths.Input + "/" + cfg.Paths.Zip
+}
+
+// loadZip loads the zip file and extracts the json files to the json folder
+func loadZip(path string) error {
+	appLog.Info("opening zip file", "file", path)
 
-	// check the environment variable for the zip file name
-	custom := os.Getenv("ZIP_NAME")
-	if custom != "" {
-		zipName = custom
-	} else {
-		zipName = "resources.zip"
+	err := extractZip(context.Background(), path, cfg.Paths.JSON, cfg.Paths.Static)
+	if err != nil {
+		return fmt.Errorf("error extracting zip file: %w", err)
 	}
+	return nil
+}
 
-	path := inputDir + "/" + zipName
-	log.Println("Opening zip file: ", path)
+// maxExtractedSize is the most bytes the files of a zip file may extract to, so a small zip file cannot fill the disk
+const maxExtractedSize = 2 << 30
 
+// extractZip extracts the json files of the zip file at path to jsonOut and the images to staticOut
+// it stops when the context is canceled or the files get bigger than maxExtractedSize
+func extractZip(ctx context.Context, path string, jsonOut string, staticOut string) error {
 	// open a zip archive for reading
 	r, err := zip.OpenReader(path)
 	if err != nil {
-		log.Fatalln("Error opening zip file: ", err)
+		return err
 	}
 	defer func(r *zip.ReadCloser) {
 		err := r.Close()
 		if err != nil {
-			log.Fatalln("Error closing zip file: ", err)
+			appLog.Warn("could not close zip file", "error", err)
 		}
 	}(r)
 
-	//check if jsonDir exists otherwise create it
-	if _, err := os.Stat(jsonDir); os.IsNotExist(err) {
-		err := os.Mkdir(jsonDir, os.ModePerm)
+	//check if jsonOut exists otherwise create it
+	if _, err := os.Stat(jsonOut); os.IsNotExist(err) {
+		err := os.MkdirAll(jsonOut, os.ModePerm)
 		if err != nil {
-			log.Fatalln("Error creating jsonDir: ", err)
+			return err
 		}
 	}
 
 	// Iterate through the files in the archive
+	remaining := int64(maxExtractedSize)
 	for _, f := range r.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		// Check if the current file is in the json folder copy it to the json folder
 		if filepath.Dir(f.Name) == "json" && !f.FileInfo().IsDir() {
-			copyZipFile(f, filepath.Join(jsonDir, filepath.Base(f.Name)))
+			path, err := zipTarget(jsonOut, filepath.Base(f.Name))
+			if err != nil {
+				return err
+			}
+			n, err := copyZipFile(f, path, remaining)
+			if err != nil {
+				return err
+			}
+			remaining -= n
 		}
 
 		// Check if the current file is in the static folder and copy it to the static folder
 		if strings.HasPrefix(f.Name, "images/") && f.Name != "images/" {
-			path := filepath.Join(statDir, f.Name)
+			path, err := zipTarget(staticOut, f.Name)
+			if err != nil {
+				return err
+			}
 			if f.FileInfo().IsDir() {
 				err := os.MkdirAll(path, f.Mode())
 				if err != nil {
-					log.Fatalln("Error creating imageDir: ", err)
+					return err
 				}
 			} else {
-				copyZipFile(f, filepath.Join(statDir, f.Name))
+				err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+				if err != nil {
+					return err
+				}
+				n, err := copyZipFile(f, path, remaining)
+				if err != nil {
+					return err
+				}
+				remaining -= n
 			}
 		}
 
 	}
+	return nil
+}
+
+// zipTarget returns the path a file of the zip archive is extracted to in the folder out
+// absolute names and names that lead outside of out are rejected, so a zip file never writes anywhere else
+// names in zip files use slashes, backslashes and drive letters come from Windows paths on every platform
+func zipTarget(out string, name string) (string, error) {
+	if path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" ||
+		strings.Contains(name, `\`) || len(name) >= 2 && name[1] == ':' {
+		return "", fmt.Errorf("invalid file name in zip: %s", name)
+	}
+	target := filepath.Join(out, name)
+	if !strings.HasPrefix(filepath.Clean(target), filepath.Clean(out)+string(os.PathSeparator)) {
+		return "", fmt.Errorf("invalid file name in zip: %s", name)
+	}
+	return target, nil
 }
 
-// copyZipFile copies a file from the zip archive to the given path
-func copyZipFile(f *zip.File, path string) {
+// copyZipFile copies a file from the zip archive to the given path and returns the number of written bytes
+// files bigger than limit are not copied completely and return an error
+func copyZipFile(f *zip.File, path string, limit int64) (int64, error) {
 	// Open the current file in the zip file
 	rc, err := f.Open()
 	if err != nil {
-		log.Fatalln("Error opening file in zip: ", err)
+		return 0, err
 	}
 	defer func(rc io.ReadCloser) {
 		err := rc.Close()
 		if err != nil {
-			log.Fatalln("Error closing file in zip: ", err)
+			appLog.Warn("could not close file in zip", "error", err)
 		}
 	}(rc)
 
 	fw, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
 	if err != nil {
-		log.Fatalln("Error creating file in json folder: ", err)
+		return 0, err
 	}
-	defer func(fw *os.File) {
-		err := fw.Close()
-		if err != nil {
-			log.Fatalln("Error closing file in json folder: ", err)
-		}
-	}(fw)
 
-	// Write the contents of the file to the target file
-	_, err = io.Copy(fw, rc)
+	// Write the contents of the file to the target file, the size in the zip header is not trusted
+	n, err := io.Copy(fw, io.LimitReader(rc, limit+1))
+	if err == nil && n > limit {
+		err = fmt.Errorf("zip file extracts to more than %d bytes", int64(maxExtractedSize))
+	}
 	if err != nil {
-		log.Fatalln(err)
+		_ = fw.Close()
+		return n, err
 	}
+	return n, fw.Close()
 }
 
-// static builds the static pages and saves them to the output folder
-func static() {
-	log.Println("Static build")
+// build builds the static pages and serves them with live reload in watch mode
+// with dryRun the changes of the build are only listed
+func build(dryRun bool) error {
+	err := static(dryRun)
+	if err != nil || !cfg.Watch || dryRun {
+		return err
+	}
+	return serveStaticBuild()
+}
 
-	//delete buildDir if exists
-	if _, err := os.Stat(buildDir); !os.IsNotExist(err) {
-		err = os.RemoveAll(buildDir)
-		if err != nil {
-			log.Fatalln("Error deleting buildDir: ", err)
-		}
+// static builds the static pages and saves them to the output folder
+// only the pages and files that changed since the last build are written
+func static(dryRun bool) error {
+	appLog.Info("static build")
+	err := loadTheme()
+	if err != nil {
+		return err
+	}
+	err = waitForDatabase()
+	if err != nil {
+		return err
 	}
 
-	log.Println("Output folder: ", outputDir)
-	renderStaticPages()
-	log.Println("Static build complete")
+	appLog.Info("output folder", "path", cfg.Paths.Output)
+	err = renderStaticPages(dryRun)
+	if err != nil {
+		return err
+	}
+	appLog.Info("static build complete")
+	return nil
 }
 
 // startWebServer starts the web server
-func dynamic() {
-	log.Println("Dynamic start")
-	startWebServer()
+func dynamic() error {
+	appLog.Info("dynamic start")
+	err := loadTheme()
+	if err != nil {
+		return err
+	}
+	return startWebServer()
 }
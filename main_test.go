@@ -0,0 +1,43 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestZipTarget(t *testing.T) {
+	out := filepath.Join("static")
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"images/a.png", filepath.Join(out, "images", "a.png")},
+		{"images/lores/a.png", filepath.Join(out, "images", "lores", "a.png")},
+		{"images/./a.png", filepath.Join(out, "images", "a.png")},
+		{"images/x/../a.png", filepath.Join(out, "images", "a.png")},
+		{"images/..a.png", filepath.Join(out, "images", "..a.png")},
+		{"../x", ""},
+		{"..", ""},
+		{".", ""},
+		{"", ""},
+		{"images/../../x", ""},
+		{"images/../../static2/x", ""},
+		{"/etc/passwd", ""},
+		{"/images/a.png", ""},
+		{`C:\x`, ""},
+		{`C:/x`, ""},
+		{`\\host\share\x`, ""},
+	}
+	for _, tt := range tests {
+		got, err := zipTarget(out, tt.name)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("zipTarget(%q) = %q, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("zipTarget(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
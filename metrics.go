@@ -0,0 +1,225 @@
+/*
+ This file contains the metrics of the application in the Prometheus text exposition format.
+ The web server serves them on /metrics: requests per route, database commands per collection,
+ template render times, the imports and the hit rates of the caches.
+ Counters, gauges and histograms are kept in memory with their label values.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/event"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsPath = "/metrics"
+
+// durationBuckets are the upper bounds in seconds of the duration histograms
+var durationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// importBuckets are the upper bounds in seconds of the import duration histogram
+var importBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+var (
+	requestsTotal   = newMetric("http_requests_total", "counter", "Number of HTTP requests by route and status.", nil, "method", "route", "status")
+	requestDuration = newMetric("http_request_duration_seconds", "histogram", "Duration of HTTP requests by route.", durationBuckets, "method", "route")
+	commandsTotal   = newMetric("mongodb_commands_total", "counter", "Number of database commands by collection, command and result.", nil, "collection", "command", "result")
+	commandDuration = newMetric("mongodb_command_duration_seconds", "histogram", "Duration of database commands by collection and command.", durationBuckets, "collection", "command")
+	renderDuration  = newMetric("template_render_duration_seconds", "histogram", "Duration of rendering a template.", durationBuckets, "template")
+	importsTotal    = newMetric("imports_total", "counter", "Number of imports of json files into the database by result.", nil, "result")
+	importDuration  = newMetric("import_duration_seconds", "histogram", "Duration of imports of json files into the database.", importBuckets)
+	importDocuments = newMetric("import_documents", "gauge", "Number of documents per collection of the last import.", nil, "collection")
+	cacheRequests   = newMetric("cache_requests_total", "counter", "Number of cache lookups by cache and result (hit or miss).", nil, "cache", "result")
+	cacheSize       = newMetric("cache_size", "gauge", "Total size of the entries of a cache, bytes for pages and entries for queries.", nil, "cache")
+	cacheEntries    = newMetric("cache_entries", "gauge", "Number of entries of a cache.", nil, "cache")
+)
+
+// metrics lists all metrics in the order they are written
+var metrics []*metric
+
+// metric is a counter, gauge or histogram with all its series
+type metric struct {
+	name    string
+	kind    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*series
+}
+
+// series is the value of a metric for one combination of label values
+type series struct {
+	labelValues []string
+	value       float64
+	// counts per bucket, sum and count of a histogram
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// newMetric creates a metric and registers it, buckets are only used by histograms
+func newMetric(name string, kind string, help string, buckets []float64, labels ...string) *metric {
+	m := &metric{name: name, kind: kind, help: help, labels: labels, buckets: buckets, series: make(map[string]*series)}
+	metrics = append(metrics, m)
+	return m
+}
+
+// get returns the series of the label values, it must be called with the lock held
+func (m *metric) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add adds the value to a counter or gauge
+func (m *metric) add(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += value
+}
+
+// set sets the value of a gauge
+func (m *metric) set(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value = value
+}
+
+// observe adds a value to a histogram
+func (m *metric) observe(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labelValues)
+	for i, bound := range m.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// since observes the seconds since start
+func (m *metric) since(start time.Time, labelValues ...string) {
+	m.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// write writes the metric in the text exposition format
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues, ""), formatValue(s.value))
+			continue
+		}
+		for i, bound := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labelValues, ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labelValues, ""), s.count)
+	}
+}
+
+// formatLabels returns the label set of a series, le is the bucket label of histograms
+func formatLabels(labels []string, values []string, le string) string {
+	var pairs []string
+	for i, label := range labels {
+		pairs = append(pairs, label+`="`+escapeLabel(values[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escapeLabel escapes a label value for the text exposition format
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatValue formats a sample value
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// metricsHandler writes all metrics
+func metricsHandler(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	for _, m := range metrics {
+		m.write(c.Writer)
+	}
+}
+
+// metricsMiddleware counts the requests and their duration by route
+// requests without a route are counted as not_found, so unknown paths do not create new series
+func metricsMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = "not_found"
+	}
+	requestsTotal.add(1, c.Request.Method, route, strconv.Itoa(c.Writer.Status()))
+	requestDuration.since(start, c.Request.Method, route)
+}
+
+// commandMonitor returns the monitor of the database client that counts the commands and their duration by collection
+func commandMonitor() *event.CommandMonitor {
+	// started maps the request id of a running command to its collection
+	var started sync.Map
+	finished := func(ctx context.Context, requestID int64, command string, duration time.Duration, result string) {
+		collection, ok := started.LoadAndDelete(requestID)
+		if !ok {
+			return
+		}
+		commandsTotal.add(1, collection.(string), command, result)
+		commandDuration.observe(duration.Seconds(), collection.(string), command)
+		logFor(ctx).Debug("database command", "database", databaseName(ctx), "collection", collection, "command", command,
+			"duration", duration, "result", result)
+	}
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			// commands on a collection have its name as value of the command, others like ping are not counted
+			if collection, ok := e.Command.Lookup(e.CommandName).StringValueOK(); ok {
+				started.Store(e.RequestID, collection)
+			}
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			finished(ctx, e.RequestID, e.CommandName, time.Duration(e.DurationNanos), "ok")
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			logFor(ctx).Warn("database command failed", "command", e.CommandName, "error", e.Failure)
+			finished(ctx, e.RequestID, e.CommandName, time.Duration(e.DurationNanos), "error")
+		},
+	}
+}
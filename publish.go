@@ -0,0 +1,153 @@
+/*
+ This file contains the publish step of the static build.
+ The files of the manifest of the last build are published to the target of PUBLISH_TARGET:
+ a local folder switched in one step through a symlink, an S3-compatible bucket or a branch of a local git repository.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// publishTarget is a place the static build is published to
+type publishTarget interface {
+	// publish publishes the files of the manifest, the files are read from the buildDir
+	publish(ctx context.Context, manifest buildManifest) error
+}
+
+// publishTargets maps the names of the targets to their constructors
+var publishTargets = map[string]func(c PublishConfig) publishTarget{
+	"dir": func(c PublishConfig) publishTarget { return dirTarget{link: c.Dir, keep: c.Keep} },
+	"s3":  newS3Target,
+	"git": func(c PublishConfig) publishTarget { return gitTarget{repo: c.GitRepo, branch: c.GitBranch} },
+}
+
+// publishBuild publishes the last static build to the configured target
+func publishBuild(ctx context.Context) error {
+	newTarget, ok := publishTargets[cfg.Publish.Target]
+	if !ok {
+		return fmt.Errorf("no publish target set, set PUBLISH_TARGET to dir, s3 or git")
+	}
+	manifest, err := loadManifest()
+	if err != nil {
+		return fmt.Errorf("could not read the manifest of the build: %w", err)
+	}
+	start := time.Now()
+	err = newTarget(cfg.Publish).publish(ctx, manifest)
+	if err != nil {
+		return fmt.Errorf("error publishing to %s: %w", cfg.Publish.Target, err)
+	}
+	appLog.Info("static build published", "target", cfg.Publish.Target, "sha256", manifest.SHA256,
+		"files", len(manifest.Files), "duration", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// loadManifest reads the manifest of the last build from the buildDir
+func loadManifest() (buildManifest, error) {
+	var manifest buildManifest
+	data, err := os.ReadFile(filepath.Join(buildDir(), manifestName))
+	if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(data, &manifest)
+	if err == nil && len(manifest.SHA256) < 16 {
+		err = fmt.Errorf("%s has no hash", manifestName)
+	}
+	return manifest, err
+}
+
+// dirTarget publishes the build to a release folder next to a symlink and then points the symlink to it
+// the web server always sees a complete release, the old one or the new one
+type dirTarget struct {
+	link string
+	keep int
+}
+
+// publish copies the build to its release folder and switches the symlink
+func (t dirTarget) publish(ctx context.Context, manifest buildManifest) error {
+	releases := t.link + ".releases"
+	name := manifest.SHA256[:16]
+	release := filepath.Join(releases, name)
+	if info, err := os.Lstat(t.link); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("%s exists and is not a symlink", t.link)
+	}
+	if _, err := os.Stat(release); os.IsNotExist(err) {
+		// a release is copied to a temporary folder first, so a failed copy never becomes a release
+		tmp := release + ".tmp"
+		_ = os.RemoveAll(tmp)
+		err = archiveFiles(manifest, func(name string, content []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			target := filepath.Join(tmp, filepath.FromSlash(name))
+			err := os.MkdirAll(filepath.Dir(target), 0755)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(target, content, 0644)
+		})
+		if err == nil {
+			err = os.Rename(tmp, release)
+		}
+		if err != nil {
+			_ = os.RemoveAll(tmp)
+			return err
+		}
+	}
+	// the time of the release orders the releases by when they were last published
+	now := time.Now()
+	_ = os.Chtimes(release, now, now)
+	// the new symlink replaces the old one with a rename, which is atomic
+	target, err := filepath.Rel(filepath.Dir(t.link), release)
+	if err != nil {
+		target = release
+	}
+	tmpLink := t.link + ".tmp"
+	_ = os.Remove(tmpLink)
+	err = os.Symlink(target, tmpLink)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpLink, t.link)
+	if err != nil {
+		_ = os.Remove(tmpLink)
+		return err
+	}
+	appLog.Info("release published", "link", t.link, "release", release)
+	return t.prune(releases, name)
+}
+
+// prune removes all releases except the published one and the t.keep newest others
+func (t dirTarget) prune(releases string, current string) error {
+	entries, err := os.ReadDir(releases)
+	if err != nil {
+		return err
+	}
+	type release struct {
+		name    string
+		modTime time.Time
+	}
+	var old []release
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.IsDir() || entry.Name() == current || filepath.Ext(entry.Name()) == ".tmp" {
+			continue
+		}
+		old = append(old, release{entry.Name(), info.ModTime()})
+	}
+	sort.Slice(old, func(i, j int) bool { return old[i].modTime.After(old[j].modTime) })
+	for i := t.keep; i < len(old); i++ {
+		appLog.Debug("removing old release", "release", old[i].name)
+		err := os.RemoveAll(filepath.Join(releases, old[i].name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
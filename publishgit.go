@@ -0,0 +1,137 @@
+/*
+ This file contains the git publish target.
+ The build is committed to a branch of a local repository with git plumbing commands and a temporary index,
+ so neither the working tree nor the index of the repository are touched, like a gh-pages branch that is pushed afterwards.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// gitTarget commits the build to a branch of a local repository
+type gitTarget struct {
+	repo   string
+	branch string
+	// index is the temporary index file the tree is written from
+	index string
+}
+
+// publish commits the files of the manifest as the only files of the branch, a build without changes makes no commit
+func (t gitTarget) publish(ctx context.Context, manifest buildManifest) error {
+	ref := "refs/heads/" + t.branch
+	head, err := t.git(ctx, nil, "symbolic-ref", "-q", "HEAD")
+	if err == nil && head == ref {
+		return fmt.Errorf("branch %s is checked out in %s", t.branch, t.repo)
+	}
+	// the files must still be the ones of the manifest
+	err = archiveFiles(manifest, func(name string, content []byte) error { return nil })
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "goportfolio-publish-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	// the index does not exist yet, git starts with an empty one
+	t.index = filepath.Join(dir, "index")
+
+	// the files are written as blobs in one call and added to the index with their ids
+	paths := make([]string, 0, len(manifest.Files)+1)
+	names := make([]string, 0, len(manifest.Files)+1)
+	for _, file := range manifest.Files {
+		paths = append(paths, filepath.Join(buildDir(), filepath.FromSlash(file.Path)))
+		names = append(names, file.Path)
+	}
+	paths = append(paths, filepath.Join(buildDir(), manifestName))
+	names = append(names, manifestName)
+	absolute := make([]string, len(paths))
+	for i, p := range paths {
+		absolute[i], err = filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+	}
+	out, err := t.git(ctx, strings.NewReader(strings.Join(absolute, "\n")+"\n"), "hash-object", "-w", "--no-filters", "--stdin-paths")
+	if err != nil {
+		return err
+	}
+	blobs := strings.Fields(out)
+	if len(blobs) != len(names) {
+		return fmt.Errorf("git hash-object returned %d ids for %d files", len(blobs), len(names))
+	}
+	// .nojekyll keeps GitHub Pages from skipping files that start with _
+	empty, err := t.git(ctx, strings.NewReader(""), "hash-object", "-w", "--stdin")
+	if err != nil {
+		return err
+	}
+	var entries strings.Builder
+	for i, name := range names {
+		fmt.Fprintf(&entries, "100644 %s\t%s\n", blobs[i], name)
+	}
+	fmt.Fprintf(&entries, "100644 %s\t.nojekyll\n", empty)
+	_, err = t.git(ctx, strings.NewReader(entries.String()), "update-index", "--add", "--index-info")
+	if err != nil {
+		return err
+	}
+	tree, err := t.git(ctx, nil, "write-tree")
+	if err != nil {
+		return err
+	}
+
+	parent, err := t.git(ctx, nil, "rev-parse", "-q", "--verify", ref+"^{commit}")
+	if err != nil {
+		parent = ""
+	}
+	if parent != "" {
+		parentTree, err := t.git(ctx, nil, "rev-parse", parent+"^{tree}")
+		if err == nil && parentTree == tree {
+			appLog.Info("branch is up to date", "repo", t.repo, "branch", t.branch)
+			return nil
+		}
+	}
+	args := []string{"commit-tree", tree, "-m", "Publish build " + manifest.SHA256[:16]}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	commit, err := t.git(ctx, nil, args...)
+	if err != nil {
+		return err
+	}
+	// the old id makes the update fail if the branch moved in the meantime
+	_, err = t.git(ctx, nil, "update-ref", "-m", "publish", ref, commit, parent)
+	if err != nil {
+		return err
+	}
+	appLog.Info("build committed", "repo", t.repo, "branch", t.branch, "commit", commit)
+	return nil
+}
+
+// git runs a git command in the repository with the temporary index and returns its trimmed output
+func (t gitTarget) git(ctx context.Context, stdin *strings.Reader, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", t.repo}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=GoPortfolio", "GIT_AUTHOR_EMAIL=goportfolio@localhost",
+		"GIT_COMMITTER_NAME=GoPortfolio", "GIT_COMMITTER_EMAIL=goportfolio@localhost")
+	if t.index != "" {
+		cmd.Env = append(cmd.Env, "GIT_INDEX_FILE="+t.index)
+	}
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
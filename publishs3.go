@@ -0,0 +1,363 @@
+/*
+ This file contains the S3 publish target.
+ It lists the objects under the prefix of the bucket, uploads the files whose content differs from their object
+ with their content type and SHA-256 and deletes the objects of the last publish that are no longer part of the build.
+ The requests are signed with AWS Signature Version 4 and address the bucket in the path,
+ so they work with AWS and with S3-compatible servers like MinIO.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// metaSHA256 is the metadata header with the SHA-256 of the content of an uploaded object
+const metaSHA256 = "X-Amz-Meta-Sha256"
+
+// s3Target uploads the build to a bucket of an S3-compatible server
+type s3Target struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// s3Object is an object of a bucket listing
+type s3Object struct {
+	Key  string `xml:"Key"`
+	ETag string `xml:"ETag"`
+	Size int64  `xml:"Size"`
+}
+
+// s3ListResult is the answer of a ListObjectsV2 request
+type s3ListResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+// newS3Target returns the S3 target of the publish settings, the endpoint is checked by the configuration
+func newS3Target(c PublishConfig) publishTarget {
+	endpoint, _ := url.Parse(strings.TrimSuffix(c.S3Endpoint, "/"))
+	prefix := strings.Trim(c.S3Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Target{
+		endpoint:  endpoint,
+		region:    c.S3Region,
+		bucket:    c.S3Bucket,
+		prefix:    prefix,
+		accessKey: c.S3AccessKey,
+		secretKey: c.S3SecretKey,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// publish uploads the changed files and deletes the objects of files that are no longer part of the build
+// pages are uploaded after the static files they link to and the manifest last
+// the .br and .gz siblings of the files are left out, S3 always sends an object as it is and never chooses one by Accept-Encoding
+// only objects listed in the manifest of the last publish are deleted, other objects under the prefix are never touched
+func (t *s3Target) publish(ctx context.Context, manifest buildManifest) error {
+	objects, err := t.list(ctx)
+	if err != nil {
+		return err
+	}
+	previous, err := t.previousFiles(ctx, objects)
+	if err != nil {
+		return err
+	}
+	type upload struct {
+		name    string
+		content []byte
+	}
+	var uploads []upload
+	keep := make(map[string]bool)
+	siblings := compressedSiblingPaths(manifest)
+	err = archiveFiles(manifest, func(name string, content []byte) error {
+		if siblings[name] {
+			return nil
+		}
+		keep[t.prefix+name] = true
+		if object, ok := objects[t.prefix+name]; ok {
+			same, err := t.unchanged(ctx, object, content)
+			if err != nil || same {
+				return err
+			}
+		}
+		uploads = append(uploads, upload{name, content})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	rank := func(name string) int {
+		switch {
+		case name == manifestName:
+			return 2
+		case path.Ext(name) == ".html":
+			return 1
+		}
+		return 0
+	}
+	sort.SliceStable(uploads, func(i, j int) bool { return rank(uploads[i].name) < rank(uploads[j].name) })
+	for _, u := range uploads {
+		err := t.put(ctx, t.prefix+u.name, u.content)
+		if err != nil {
+			return err
+		}
+	}
+	deleted := 0
+	for key := range previous {
+		if _, ok := objects[key]; !ok || keep[key] {
+			continue
+		}
+		err := t.delete(ctx, key)
+		if err != nil {
+			return err
+		}
+		deleted++
+	}
+	appLog.Info("bucket updated", "bucket", t.bucket, "prefix", t.prefix, "uploaded", len(uploads),
+		"unchanged", len(keep)-len(uploads), "deleted", deleted)
+	return nil
+}
+
+// list returns the objects under the prefix by their key
+func (t *s3Target) list(ctx context.Context) (map[string]s3Object, error) {
+	objects := make(map[string]s3Object)
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {t.prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		body, _, err := t.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not list bucket %s: %w", t.bucket, err)
+		}
+		var result s3ListResult
+		err = xml.Unmarshal(body, &result)
+		if err != nil {
+			return nil, fmt.Errorf("could not read listing of bucket %s: %w", t.bucket, err)
+		}
+		for _, object := range result.Contents {
+			objects[object.Key] = object
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// previousFiles returns the keys of the files in the manifest of the last publish, none if there is no manifest
+func (t *s3Target) previousFiles(ctx context.Context, objects map[string]s3Object) (map[string]bool, error) {
+	files := make(map[string]bool)
+	if _, ok := objects[t.prefix+manifestName]; !ok {
+		return files, nil
+	}
+	body, _, err := t.do(ctx, http.MethodGet, t.prefix+manifestName, nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not download the manifest of the last publish: %w", err)
+	}
+	var previous buildManifest
+	err = json.Unmarshal(body, &previous)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the manifest of the last publish: %w", err)
+	}
+	for _, file := range previous.Files {
+		files[t.prefix+file.Path] = true
+	}
+	return files, nil
+}
+
+// unchanged reports if an object has the content, by the MD5 in its ETag or else by the SHA-256 in its metadata
+// the ETag of objects uploaded in parts or encrypted with SSE-KMS is not the MD5 of their content
+func (t *s3Target) unchanged(ctx context.Context, object s3Object, content []byte) (bool, error) {
+	if object.Size != int64(len(content)) {
+		return false, nil
+	}
+	sum := md5.Sum(content)
+	if strings.Trim(object.ETag, `"`) == hex.EncodeToString(sum[:]) {
+		return true, nil
+	}
+	_, header, err := t.do(ctx, http.MethodHead, object.Key, nil, nil, nil)
+	if err != nil {
+		return false, fmt.Errorf("could not check %s: %w", object.Key, err)
+	}
+	hash := sha256.Sum256(content)
+	return header.Get(metaSHA256) == hex.EncodeToString(hash[:]), nil
+}
+
+// put uploads an object with the content type of its extension and the SHA-256 of its content as metadata
+func (t *s3Target) put(ctx context.Context, key string, content []byte) error {
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	hash := sha256.Sum256(content)
+	header := http.Header{"Content-Type": {contentType}, metaSHA256: {hex.EncodeToString(hash[:])}}
+	appLog.Debug("uploading object", "key", key, "content_type", contentType)
+	_, _, err := t.do(ctx, http.MethodPut, key, nil, content, header)
+	if err != nil {
+		return fmt.Errorf("could not upload %s: %w", key, err)
+	}
+	return nil
+}
+
+// delete deletes an object
+func (t *s3Target) delete(ctx context.Context, key string) error {
+	appLog.Debug("deleting object", "key", key)
+	_, _, err := t.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("could not delete %s: %w", key, err)
+	}
+	return nil
+}
+
+// do sends a signed request with the headers for the bucket or one of its objects and returns the body and headers of the answer
+// answers other than 2xx are returned as error with the code of the S3 error document
+func (t *s3Target) do(ctx context.Context, method string, key string, query url.Values, body []byte, header http.Header) ([]byte, http.Header, error) {
+	escapedPath := t.endpoint.EscapedPath() + "/" + awsEscape(t.bucket, false)
+	if key != "" {
+		escapedPath += "/" + awsEscape(key, true)
+	}
+	target := t.endpoint.Scheme + "://" + t.endpoint.Host + escapedPath
+	if len(query) > 0 {
+		target += "?" + canonicalQuery(query)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	t.sign(req, escapedPath, query, body, time.Now())
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var s3Err struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		_ = xml.Unmarshal(data, &s3Err)
+		return nil, nil, fmt.Errorf("%s: %s %s", resp.Status, s3Err.Code, s3Err.Message)
+	}
+	return data, resp.Header, nil
+}
+
+// sign adds the AWS Signature Version 4 headers to a request
+// the host, the content type and all x-amz- headers like the metadata are signed
+func (t *s3Target) sign(req *http.Request, escapedPath string, query url.Values, body []byte, now time.Time) {
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := []string{"host"}
+	for name := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			signed = append(signed, name)
+		}
+	}
+	sort.Strings(signed)
+	var headers strings.Builder
+	for _, name := range signed {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method, escapedPath, canonicalQuery(query), headers.String(), strings.Join(signed, ";"), payloadHash,
+	}, "\n")
+	scope := date + "/" + t.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	signature := hex.EncodeToString(hmacSHA256(signingKey(t.secretKey, date, t.region, "s3"), stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+t.accessKey+"/"+scope+
+		", SignedHeaders="+strings.Join(signed, ";")+", Signature="+signature)
+}
+
+// signingKey derives the key of Signature Version 4 for a day, region and service
+func signingKey(secret string, date string, region string, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of the data with the key
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery returns the query sorted by key with both keys and values escaped as Signature Version 4 expects
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, awsEscape(key, false)+"="+awsEscape(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape escapes every byte except letters, digits and -._~ and with keepSlash also /
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 || keepSlash && c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
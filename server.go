@@ -0,0 +1,83 @@
+/*
+ This file contains the http server used by the web server and by the server of the static build in watch mode.
+ It applies the timeouts of the configuration and shuts down gracefully on SIGINT and SIGTERM:
+ it stops accepting connections, lets running requests finish and disconnects the database.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// stopping is closed when the server shuts down, so event streams end and do not hold up the shutdown
+var stopping = make(chan struct{})
+
+// serve runs the http server with the handler until it fails or the process gets SIGINT or SIGTERM
+func serve(handler http.Handler) error {
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Server.Port),
+		Handler:           handler,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+		MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+	}
+	server.RegisterOnShutdown(func() {
+		close(stopping)
+	})
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	// the database and the access log are closed however the server ends
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Database.Timeout)
+		defer cancel()
+		closeDatabase(ctx)
+		if accessLog != nil {
+			accessLog.close()
+		}
+	}()
+
+	errs := make(chan error, 1)
+	go func() {
+		appLog.Info("listening", "addr", server.Addr)
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return fmt.Errorf("error starting web server: %w", err)
+	case sig := <-signals:
+		appLog.Info("shutting down", "signal", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		appLog.Warn("not all requests finished in time", "error", err)
+		_ = server.Close()
+	}
+	if err := <-errs; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		appLog.Error("could not stop web server", "error", err)
+	}
+	appLog.Info("server stopped")
+	return nil
+}
+
+// streamEnd returns a channel that fires shortly before the write timeout ends an event stream,
+// the stream is closed then and the browser reconnects, without a write timeout it never fires
+func streamEnd() <-chan time.Time {
+	if cfg.Server.WriteTimeout <= 0 {
+		return nil
+	}
+	return time.After(cfg.Server.WriteTimeout - time.Second)
+}
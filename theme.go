@@ -0,0 +1,282 @@
+/*
+ This file contains the themes, a theme is a named bundle of templates and static files.
+ The default theme is the templates and static folder, every other theme is a folder in themes/
+ with its own templates and static folder and an optional theme.json.
+ A theme falls back to its parent theme and finally to the default theme for every template
+ and static file it does not define itself.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"path"
+	"strings"
+	"text/template/parse"
+)
+
+const (
+	defaultTheme = "default"
+	themesDir    = "themes"
+)
+
+var (
+	// requiredTemplates are the templates every theme must define, directly or by its fallback
+	requiredTemplates = []string{homeTempl, productTempl, impTempl, errorTempl}
+	// themeChain lists the selected theme and its parents without the default theme, the selected theme is last
+	themeChain []string
+)
+
+// themeInfo is the content of the optional theme.json of a theme
+type themeInfo struct {
+	Parent      string `json:"parent"`
+	Description string `json:"description"`
+}
+
+// loadTheme loads the theme selected in the configuration and checks it defines all required templates
+// it is called by main.go before anything is rendered
+func loadTheme() error {
+	name := cfg.Theme
+	chain, err := checkTheme(assets(), name)
+	if err != nil {
+		return err
+	}
+	themeChain = chain
+	if len(chain) > 0 {
+		fallback := append(reversed(chain[:len(chain)-1]), defaultTheme)
+		appLog.Info("theme", "name", name, "fallback", strings.Join(fallback, ","))
+	} else {
+		appLog.Info("theme", "name", name)
+	}
+	return nil
+}
+
+// checkTheme returns the chain of the theme in fsys after checking the templates of every theme of the chain,
+// see checkThemeTemplates, and that the default templates and the chain define all required templates
+func checkTheme(fsys fs.FS, name string) ([]string, error) {
+	chain, err := resolveTheme(fsys, name)
+	if err != nil {
+		return nil, fmt.Errorf("error loading theme: %w", err)
+	}
+	tmpl, err := parseThemeTemplates(fsys, chainDirs(chain), templateFuncs())
+	if err != nil {
+		return nil, fmt.Errorf("error loading theme %s: %w", name, err)
+	}
+	for _, theme := range chain {
+		err = checkThemeTemplates(fsys, theme, tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("error loading theme %s: %w", name, err)
+		}
+	}
+	return chain, nil
+}
+
+// checkThemeTemplates parses the templates of a single theme on their own and checks them against all templates:
+// a template the theme defines must replace a template of the default theme, be required or be used by a template,
+// so a misspelled name does not silently fall back to the default template, and every template it uses must exist
+func checkThemeTemplates(fsys fs.FS, theme string, all *template.Template) error {
+	pattern := path.Join(themesDir, theme, templatePattern)
+	if matches, _ := fs.Glob(fsys, pattern); len(matches) == 0 {
+		return nil
+	}
+	own, err := template.New("").Funcs(templateFuncs()).ParseFS(fsys, pattern)
+	if err != nil {
+		return fmt.Errorf("theme %s: %w", theme, err)
+	}
+	defaults, err := template.New("").Funcs(templateFuncs()).ParseFS(fsys, templatePattern)
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, name := range requiredTemplates {
+		used[name] = true
+	}
+	for _, t := range all.Templates() {
+		if t.Tree != nil {
+			templateCalls(t.Tree.Root, used)
+		}
+	}
+	for _, t := range own.Templates() {
+		// every file is a template of its own name besides the templates it defines
+		if t.Name() == "" || strings.HasSuffix(t.Name(), ".html") || t.Tree == nil {
+			continue
+		}
+		if defaults.Lookup(t.Name()) == nil && !used[t.Name()] {
+			return fmt.Errorf("theme %s defines template %s, which is neither a template of the default theme nor used", theme, t.Name())
+		}
+		calls := make(map[string]bool)
+		templateCalls(t.Tree.Root, calls)
+		for call := range calls {
+			if all.Lookup(call) == nil {
+				return fmt.Errorf("template %s of theme %s uses the undefined template %s", t.Name(), theme, call)
+			}
+		}
+	}
+	return nil
+}
+
+// templateCalls adds the names of the templates called in the tree of node to names
+func templateCalls(node parse.Node, names map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			templateCalls(child, names)
+		}
+	case *parse.TemplateNode:
+		names[n.Name] = true
+	case *parse.IfNode:
+		templateCalls(n.List, names)
+		templateCalls(n.ElseList, names)
+	case *parse.RangeNode:
+		templateCalls(n.List, names)
+		templateCalls(n.ElseList, names)
+	case *parse.WithNode:
+		templateCalls(n.List, names)
+		templateCalls(n.ElseList, names)
+	}
+}
+
+// resolveTheme returns the given theme and its parents without the default theme, the given theme is last
+// a theme name is the name of a single folder in themes/
+func resolveTheme(fsys fs.FS, name string) ([]string, error) {
+	var chain []string
+	for name != defaultTheme && name != "" {
+		if name == "." || name == ".." || strings.ContainsAny(name, `/\`) || !fs.ValidPath(name) {
+			return nil, fmt.Errorf("invalid theme name %q", name)
+		}
+		for _, theme := range chain {
+			if theme == name {
+				return nil, fmt.Errorf("theme %s is its own parent", name)
+			}
+		}
+		if _, err := fs.Stat(fsys, path.Join(themesDir, name)); err != nil {
+			return nil, fmt.Errorf("unknown theme %s, available themes: %s", name, strings.Join(availableThemes(fsys), ", "))
+		}
+		info, err := readThemeInfo(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		chain = append([]string{name}, chain...)
+		name = info.Parent
+	}
+	return chain, nil
+}
+
+// readThemeInfo reads the theme.json of a theme, a theme without one falls back to the default theme
+func readThemeInfo(fsys fs.FS, name string) (themeInfo, error) {
+	var info themeInfo
+	content, err := fs.ReadFile(fsys, path.Join(themesDir, name, "theme.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return info, nil
+	}
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(content, &info)
+	if err != nil {
+		return info, fmt.Errorf("invalid theme.json of theme %s: %w", name, err)
+	}
+	return info, nil
+}
+
+// availableThemes returns the names of all themes
+func availableThemes(fsys fs.FS) []string {
+	themes := []string{defaultTheme}
+	entries, err := fs.ReadDir(fsys, themesDir)
+	if err != nil {
+		return themes
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			themes = append(themes, entry.Name())
+		}
+	}
+	return themes
+}
+
+// themeDirs returns the folders of the themes in themeChain
+func themeDirs() []string {
+	return chainDirs(themeChain)
+}
+
+// chainDirs returns the folders of the themes of a chain
+func chainDirs(chain []string) []string {
+	var dirs []string
+	for _, theme := range chain {
+		dirs = append(dirs, path.Join(themesDir, theme))
+	}
+	return dirs
+}
+
+// parseTemplates parses the templates of the default theme and then of every theme of the chain
+// a template defined by a theme replaces the one of the theme before
+func parseTemplates() (*template.Template, error) {
+	return parseTemplatesWith(templateFuncs())
+}
+
+// parseTemplatesWith parses the templates like parseTemplates with other template functions
+func parseTemplatesWith(funcs template.FuncMap) (*template.Template, error) {
+	return parseThemeTemplates(assets(), themeDirs(), funcs)
+}
+
+// parseThemeTemplates parses the default templates of fsys and then the ones of every theme folder in dirs
+// and checks that all required templates are defined
+func parseThemeTemplates(fsys fs.FS, dirs []string, funcs template.FuncMap) (*template.Template, error) {
+	tmpl, err := template.New("").Funcs(funcs).ParseFS(fsys, templatePattern)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		pattern := path.Join(dir, templatePattern)
+		if matches, _ := fs.Glob(fsys, pattern); len(matches) == 0 {
+			continue
+		}
+		tmpl, err = tmpl.ParseFS(fsys, pattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var missing []string
+	for _, name := range requiredTemplates {
+		if tmpl.Lookup(name) == nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing required templates: %s", strings.Join(missing, ", "))
+	}
+	return tmpl, nil
+}
+
+// themeStaticFS returns the static files of the theme chain, the selected theme's files come first
+func themeStaticFS(fsys fs.FS) (fs.FS, error) {
+	var layers overlayFS
+	dirs := themeDirs()
+	for i := len(dirs) - 1; i >= 0; i-- {
+		static, err := fs.Sub(fsys, path.Join(dirs[i], "static"))
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, static)
+	}
+	static, err := fs.Sub(fsys, "static")
+	if err != nil {
+		return nil, err
+	}
+	return append(layers, static), nil
+}
+
+// reversed returns a reversed copy of the list
+func reversed(list []string) []string {
+	result := make([]string, 0, len(list))
+	for i := len(list) - 1; i >= 0; i-- {
+		result = append(result, list[i])
+	}
+	return result
+}
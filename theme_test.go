@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testdata/themes has a default theme without the error template, the theme incomplete replaces its home template
+// and the theme complete adds the error template on top of incomplete,
+// the themes broken, misspelled and undefined have a parse error, a misspelled template and a call of a missing template,
+// the last two on top of complete
+func TestCheckTheme(t *testing.T) {
+	fixture := os.DirFS("testdata/themes")
+	tests := []struct {
+		theme string
+		chain []string
+		err   string
+	}{
+		{defaultTheme, nil, "missing required templates: error"},
+		{"incomplete", nil, "missing required templates: error"},
+		{"complete", []string{"incomplete", "complete"}, ""},
+		{"unknown", nil, "unknown theme unknown"},
+		{"broken", nil, "missing value for if"},
+		{"misspelled", nil, "theme misspelled defines template hom"},
+		{"undefined", nil, "uses the undefined template hedaer"},
+		{".", nil, `invalid theme name "."`},
+		{"..", nil, `invalid theme name ".."`},
+		{"complete/..", nil, `invalid theme name "complete/.."`},
+		{"../themes/complete", nil, "invalid theme name"},
+		{`complete\x`, nil, "invalid theme name"},
+	}
+	for _, tt := range tests {
+		chain, err := checkTheme(fixture, tt.theme)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("checkTheme(%s) = %v, want error %q", tt.theme, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("checkTheme(%s) = %v", tt.theme, err)
+			continue
+		}
+		if !reflect.DeepEqual(chain, tt.chain) {
+			t.Errorf("checkTheme(%s) chain = %v, want %v", tt.theme, chain, tt.chain)
+		}
+	}
+}
+
+func TestThemeFallback(t *testing.T) {
+	fixture := os.DirFS("testdata/themes")
+	tmpl, err := parseThemeTemplates(fixture, chainDirs([]string{"incomplete", "complete"}), templateFuncs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each template comes from the nearest theme of the chain that defines it
+	for name, want := range map[string]string{
+		homeTempl:    "incomplete home",
+		productTempl: "default product",
+		impTempl:     "default impressum",
+		errorTempl:   "complete error",
+	} {
+		var buf bytes.Buffer
+		err := tmpl.ExecuteTemplate(&buf, name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != want {
+			t.Errorf("template %s = %q, want %q", name, buf.String(), want)
+		}
+	}
+}
+
+func TestPlainTheme(t *testing.T) {
+	chain, err := checkTheme(embedded, "plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := parseThemeTemplates(embedded, chainDirs(chain), templateFuncs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// plain replaces these templates, the product page falls back to the default theme
+	tests := []struct {
+		template string
+		contains string
+		want     bool
+	}{
+		{homeTempl, "<canvas>", false},
+		{homeTempl, `id="flip"`, false},
+		{"head", "styles/plain.css", true},
+		{"footer", "js/background.js", false},
+		{productTempl, "<canvas>", true},
+	}
+	for _, tt := range tests {
+		source := tmpl.Lookup(tt.template).Tree.Root.String()
+		if strings.Contains(source, tt.contains) != tt.want {
+			t.Errorf("template %s contains %q: %v, want %v", tt.template, tt.contains, !tt.want, tt.want)
+		}
+	}
+	if _, err := fs.Stat(embedded, "themes/plain/static/styles/plain.css"); err != nil {
+		t.Errorf("plain theme has no stylesheet: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+ This file contains the validation of a zip file before it is imported.
+ It checks that every json file exists and that the entries have the fields
+ the webserver and the static build expect, without using the database.
+*/
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// requiredFields lists the string fields every entry of a collection needs
+var requiredFields = map[string][]string{
+	projects: {"id", "name", "img", "long", "date"},
+	software: {"id", "name", "img", "description", "company", "externallink"},
+}
+
+// validateZip checks the json files of a zip file, problems that break pages are errors
+// and problems that only lead to missing images or links are logged as warnings
+func validateZip(zipPath string) error {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return err
+	}
+	defer func(r *zip.ReadCloser) {
+		err := r.Close()
+		if err != nil {
+			appLog.Warn("could not close zip file", "error", err)
+		}
+	}(r)
+
+	files := make(map[string]*zip.File)
+	for _, f := range r.File {
+		files[f.Name] = f
+	}
+
+	var problems, warnings []string
+	entries := make(map[string][]map[string]interface{})
+	for _, collection := range collections {
+		name := "json/" + collection + ".json"
+		f, ok := files[name]
+		if !ok {
+			problems = append(problems, name+": missing")
+			continue
+		}
+		list, err := readZipJSON(f)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		entries[collection] = list
+		problems = append(problems, checkEntries(collection, list)...)
+	}
+
+	// references between the collections and to the images
+	toolIDs := make(map[string]bool)
+	for _, tool := range entries[software] {
+		if id, ok := tool["id"].(string); ok {
+			toolIDs[id] = true
+		}
+	}
+	for i, project := range entries[projects] {
+		label := fmt.Sprintf("projects[%d]", i)
+		for _, tool := range objectList(project["software"]) {
+			if id, ok := tool["id"].(string); ok && !toolIDs[id] {
+				warnings = append(warnings, fmt.Sprintf("%s: software %q does not exist, its link is dead", label, id))
+			}
+		}
+	}
+	for _, collection := range []string{projects, software} {
+		for i, entry := range entries[collection] {
+			if img, ok := entry["img"].(string); ok && img != "" {
+				if _, ok := files[path.Join("images/hires", img)]; !ok {
+					warnings = append(warnings, fmt.Sprintf("%s[%d]: image images/hires/%s is missing", collection, i, img))
+				}
+			}
+		}
+	}
+
+	for _, warning := range warnings {
+		appLog.Warn(warning)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid zip file %s:\n  - %s", zipPath, strings.Join(problems, "\n  - "))
+	}
+	appLog.Info("zip file is valid", "file", zipPath, "warnings", len(warnings))
+	return nil
+}
+
+// readZipJSON reads a json file of the zip file as list of objects
+func readZipJSON(f *zip.File) ([]map[string]interface{}, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer func(rc io.ReadCloser) {
+		err := rc.Close()
+		if err != nil {
+			appLog.Warn("could not close file in zip", "error", err)
+		}
+	}(rc)
+	var list []map[string]interface{}
+	err = json.NewDecoder(rc).Decode(&list)
+	if err != nil {
+		return nil, fmt.Errorf("not a list of objects: %w", err)
+	}
+	if len(list) == 0 {
+		// InsertMany fails for an empty list
+		return nil, fmt.Errorf("no entries")
+	}
+	return list, nil
+}
+
+// checkEntries checks the fields of all entries of a collection and that their ids are unique
+func checkEntries(collection string, list []map[string]interface{}) []string {
+	var problems []string
+	ids := make(map[string]int)
+	for i, entry := range list {
+		label := fmt.Sprintf("%s[%d]", collection, i)
+		for _, field := range requiredFields[collection] {
+			if _, ok := entry[field].(string); !ok {
+				problems = append(problems, fmt.Sprintf("%s: field %q must be a string", label, field))
+			}
+		}
+		if id, ok := entry["id"].(string); ok && requiredFields[collection] != nil {
+			if first, ok := ids[id]; ok {
+				problems = append(problems, fmt.Sprintf("%s: id %q is already used by %s[%d]", label, id, collection, first))
+			}
+			ids[id] = i
+		}
+		if collection != projects {
+			continue
+		}
+		if date, ok := entry["date"].(string); ok && len(date) < 4 {
+			problems = append(problems, fmt.Sprintf("%s: field \"date\" must start with the year, got %q", label, date))
+		}
+		for _, field := range []string{"software", "skills"} {
+			if _, ok := entry[field].([]interface{}); !ok {
+				problems = append(problems, fmt.Sprintf("%s: field %q must be a list", label, field))
+			}
+		}
+		for j, tool := range objectList(entry["software"]) {
+			if _, ok := tool["id"].(string); !ok {
+				problems = append(problems, fmt.Sprintf("%s: software[%d] needs an id", label, j))
+			}
+		}
+		for j, category := range objectList(entry["categories"]) {
+			if _, ok := category["name"].(string); !ok {
+				problems = append(problems, fmt.Sprintf("%s: categories[%d] needs a name", label, j))
+			}
+		}
+	}
+	return problems
+}
+
+// objectList returns the objects of a json list, other values are skipped
+func objectList(value interface{}) []map[string]interface{} {
+	list, _ := value.([]interface{})
+	var objects []map[string]interface{}
+	for _, item := range list {
+		if object, ok := item.(map[string]interface{}); ok {
+			objects = append(objects, object)
+		}
+	}
+	return objects
+}
@@ -0,0 +1,367 @@
+/*
+ This file contains the watch mode for working on the content, templates and styles.
+ If watch mode is configured, the input, templates and static folders are polled for changes.
+ A changed zip file is imported again, changed templates are parsed again and
+ the static build is updated if the static build is configured.
+ Open browser tabs are reloaded by a live-reload event sent over server-sent events.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	watchInterval = time.Second
+	reloadPath    = "/livereload"
+	// reloadScript is injected into every html page in watch mode to reload it on changes, %s is the path of the stream
+	reloadScript = `<script>new EventSource("%s").addEventListener("reload", function () { location.reload(); });</script>`
+)
+
+var (
+	// reloadSubs are the channels of all open live-reload streams
+	reloadSubs = make(map[chan string]struct{})
+	reloadMux  sync.Mutex
+)
+
+// fileStamp is the state of a watched file used to detect changes
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// watchTarget is a folder that is watched and the function that handles its changes
+type watchTarget struct {
+	dir      string
+	onChange func(changed []string)
+	files    map[string]fileStamp
+	pending  []string
+}
+
+// startWatching watches the input, templates and static folders and handles their changes in the background
+// reloadTemplates loads the templates of the web server again, it is nil for the static build
+func startWatching(reloadTemplates func() error) {
+	static := reloadTemplates == nil
+	targets := []*watchTarget{
+		{dir: cfg.Paths.Input, onChange: func(changed []string) {
+			onContentChange(changed, static)
+		}},
+		{dir: filepath.Join(assetsOverride(), "templates"), onChange: func(changed []string) {
+			onTemplateChange(changed, reloadTemplates)
+		}},
+		{dir: cfg.Paths.Static, onChange: func(changed []string) {
+			onStaticChange(static)
+		}},
+		{dir: filepath.Join(assetsOverride(), themesDir), onChange: func(changed []string) {
+			onTemplateChange(changed, reloadTemplates)
+		}},
+	}
+	// static files of the override folder, the working directory is the same as the static folder
+	if dir := filepath.Join(assetsOverride(), "static"); filepath.Clean(dir) != filepath.Clean(cfg.Paths.Static) {
+		targets = append(targets, &watchTarget{dir: dir, onChange: func(changed []string) {
+			onStaticChange(static)
+		}})
+	}
+	for _, target := range targets {
+		target.files = scanDir(target.dir)
+		appLog.Info("watching", "dir", target.dir, "files", len(target.files))
+	}
+
+	go func() {
+		for range time.Tick(watchInterval) {
+			for _, target := range targets {
+				target.poll()
+			}
+		}
+	}()
+}
+
+// poll scans the folder of the target and calls onChange when the changes have settled
+// files are written over several polls, so the target waits for a poll without new changes
+func (t *watchTarget) poll() {
+	files := scanDir(t.dir)
+	changed := diffStamps(t.files, files)
+	t.files = files
+	if len(changed) > 0 {
+		t.pending = append(t.pending, changed...)
+		return
+	}
+	if len(t.pending) > 0 {
+		pending := t.pending
+		t.pending = nil
+		appLog.Info("changes", "dir", t.dir, "files", pending)
+		t.onChange(pending)
+	}
+}
+
+// scanDir returns the stamps of all files in the folder
+func scanDir(dir string) map[string]fileStamp {
+	files := make(map[string]fileStamp)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[path] = fileStamp{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	if err != nil {
+		appLog.Warn("could not scan folder", "dir", dir, "error", err)
+	}
+	return files
+}
+
+// diffStamps returns all files that were added, changed or removed
+func diffStamps(old map[string]fileStamp, current map[string]fileStamp) []string {
+	var changed []string
+	for path, stamp := range current {
+		if previous, ok := old[path]; !ok || previous != stamp {
+			changed = append(changed, path)
+		}
+	}
+	for path := range old {
+		if _, ok := current[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
+
+// onContentChange imports the zip file of the input folder into a new database and switches to it
+func onContentChange(changed []string, static bool) {
+	zipPath := filepath.Join(cfg.Paths.Input, cfg.Paths.Zip)
+	if !containsPath(changed, zipPath) {
+		return
+	}
+	err := extractZip(context.Background(), zipPath, cfg.Paths.JSON, cfg.Paths.Static)
+	if err != nil {
+		appLog.Error("could not extract zip file", "error", err)
+		return
+	}
+	id, err := newJobID()
+	if err != nil {
+		appLog.Error("could not create database name", "error", err)
+		return
+	}
+	name := stagingPrefix() + id
+	err = importJSON(withDatabase(context.Background(), name), cfg.Paths.JSON, nil)
+	if err != nil {
+		appLog.Error("could not import json files", "error", err)
+		dropDatabase(name)
+		return
+	}
+	err = switchLiveDatabase(name)
+	if err != nil {
+		appLog.Error("could not switch live database", "error", err)
+		dropDatabase(name)
+		return
+	}
+	if static {
+		rebuildPages()
+	}
+	broadcastReload()
+}
+
+// onTemplateChange loads the templates of the web server again or updates the static build,
+// the static files of a changed theme are part of it
+func onTemplateChange(changed []string, reloadTemplates func() error) {
+	if reloadTemplates == nil {
+		rebuildPages()
+	} else if err := reloadTemplates(); err != nil {
+		appLog.Error("could not reload templates", "error", err)
+		return
+	}
+	broadcastReload()
+}
+
+// onStaticChange updates the static build with the changed static files
+// the files are taken from staticFS, so a removed file is replaced by the one it shadowed
+func onStaticChange(static bool) {
+	if static {
+		rebuildPages()
+	} else if err := reloadAssets(); err != nil {
+		appLog.Error("could not prepare static files", "error", err)
+	}
+	// the home page shows a placeholder for missing images
+	invalidateCaches()
+	broadcastReload()
+}
+
+// rebuildPages updates the pages and static files of the static build that changed
+func rebuildPages() {
+	tmpl, err := parseTemplates()
+	if err != nil {
+		appLog.Error("could not parse templates", "error", err)
+		return
+	}
+	err = buildSite(context.Background(), tmpl, false)
+	if err != nil {
+		appLog.Error("could not update static build", "error", err)
+	}
+}
+
+// containsPath reports if the list contains the path
+func containsPath(paths []string, path string) bool {
+	for _, p := range paths {
+		if filepath.Clean(p) == filepath.Clean(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveStaticBuild serves the static build with live reload while watching for changes
+func serveStaticBuild() error {
+	router := newRouter()
+	router.Use(compressResponses)
+	setupLiveReload(router)
+	fileServer := http.StripPrefix(basePath(), http.FileServer(http.Dir(buildDir())))
+	router.NoRoute(gin.WrapH(fileServer))
+	redirectToBasePath(router)
+	startWatching(nil)
+	appLog.Info("serving static build")
+	return serve(router)
+}
+
+// setupLiveReload adds the live-reload stream and injects the live-reload script into html responses
+func setupLiveReload(router *gin.Engine) {
+	router.Use(injectReloadScript)
+	router.GET(basePath()+reloadPath, liveReloadHandler)
+}
+
+// liveReloadHandler streams a reload event to the browser whenever something changed
+func liveReloadHandler(c *gin.Context) {
+	ch := make(chan string, 1)
+	reloadMux.Lock()
+	reloadSubs[ch] = struct{}{}
+	reloadMux.Unlock()
+	defer func() {
+		reloadMux.Lock()
+		delete(reloadSubs, ch)
+		reloadMux.Unlock()
+	}()
+
+	end := streamEnd()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event := <-ch:
+			c.SSEvent(event, time.Now().Unix())
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		case <-end:
+			return false
+		case <-stopping:
+			return false
+		}
+	})
+}
+
+// broadcastReload sends a reload event to all open browser tabs
+func broadcastReload() {
+	reloadMux.Lock()
+	defer reloadMux.Unlock()
+	for ch := range reloadSubs {
+		select {
+		case ch <- "reload":
+		default:
+			// a reload is already pending for this tab
+		}
+	}
+}
+
+// reloadWriter buffers an html response to inject the live-reload script
+// streamed responses like server-sent events are passed through on the first flush
+type reloadWriter struct {
+	gin.ResponseWriter
+	buf         bytes.Buffer
+	passthrough bool
+}
+
+// Write buffers the response body
+func (w *reloadWriter) Write(b []byte) (int, error) {
+	if w.passthrough {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.buf.Write(b)
+}
+
+// WriteString buffers the response body
+func (w *reloadWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush switches to passing the body through unless the response is html
+func (w *reloadWriter) Flush() {
+	if !w.passthrough && !w.isHTML() {
+		w.passthrough = true
+		_, err := w.ResponseWriter.Write(w.buf.Bytes())
+		if err != nil {
+			appLog.Warn("could not write response", "error", err)
+		}
+		w.buf.Reset()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// isHTML reports if the response is an html page
+func (w *reloadWriter) isHTML() bool {
+	return strings.HasPrefix(w.Header().Get("Content-Type"), "text/html")
+}
+
+// injectReloadScript is a middleware that adds the live-reload script in front of the closing body tag
+func injectReloadScript(c *gin.Context) {
+	if c.Request.URL.Path == basePath()+reloadPath {
+		c.Next()
+		return
+	}
+	writer := &reloadWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	c.Next()
+	c.Writer = writer.ResponseWriter
+
+	body := writer.buf.Bytes()
+	if writer.passthrough {
+		return
+	}
+	if writer.isHTML() {
+		if i := bytes.LastIndex(body, []byte("</body>")); i >= 0 {
+			script := fmt.Sprintf(reloadScript, basePath()+reloadPath)
+			body = append(body[:i:i], append([]byte(script), body[i:]...)...)
+		}
+		writer.Header().Del("Content-Length")
+	}
+	_, err := writer.ResponseWriter.Write(body)
+	if err != nil {
+		appLog.Warn("could not write response", "error", err)
+	}
+}
+
+// reloadTemplates loads the templates of the web server again
+func reloadTemplates() error {
+	tmpl, err := parseTemplates()
+	if err != nil {
+		return err
+	}
+	setTemplates(tmpl)
+	// the static files of a changed theme get new fingerprints
+	err = reloadAssets()
+	if err != nil {
+		return err
+	}
+	invalidateCaches()
+	return nil
+}
@@ -1,112 +1,286 @@
 /*
  This file contains all building functions to generate the static website
-
+ Every page and static file is planned with a hash of everything it is made from,
+ only the files whose hash changed since the last build are written by a pool of workers
+ and the files of earlier builds that are not part of this one are removed.
 */
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"html/template"
 	"io"
-	"io/ioutil"
-	"log"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 )
 
-// renderStaticPages renders all static pages and writes them to the buildDir
+// buildFile is a file of the static build and how it is made
+type buildFile struct {
+	// path is the slash separated path in the buildDir
+	path string
+	// input is the hash of the data, templates and assets the file is made from, "" if it is always written
+	input   string
+	content func() ([]byte, error)
+}
+
+// renderStaticPages renders all static pages and copies the static files to the buildDir
+// with dryRun nothing is written, the files that would be added, changed or deleted are listed instead
 // it is called by main.go
-func renderStaticPages() {
+func renderStaticPages(dryRun bool) error {
 	// Parse and compile the templates
-	tmpl := template.Must(template.ParseGlob("templates/**/*.templ.html"))
-
-	//copy static files
-	err := copyDir("static", buildDir+"/static")
+	tmpl, err := parseTemplates()
 	if err != nil {
-		log.Fatalln("Error copying static files: ", err)
+		return fmt.Errorf("error parsing templates: %w", err)
 	}
+	return buildSite(context.Background(), tmpl, dryRun)
+}
 
-	// generate pages
-	generatePage(tmpl.Lookup("home"), homeData(), "index.html")
-	generatePage(tmpl.Lookup("impressum"), impressumData(), "impressum.html")
-	err = generateProductpages(projects, "project", tmpl)
+// buildSite plans all files of the static build from the database of the context and writes the changed ones
+func buildSite(ctx context.Context, tmpl *template.Template, dryRun bool) error {
+	start := time.Now()
+	static, err := staticFS()
 	if err != nil {
-		log.Fatalln("Error generating project pages: ", err)
+		return fmt.Errorf("error preparing static files: %w", err)
 	}
-	err = generateProductpages(software, "tool", tmpl)
+	index, err := loadAssets(static)
 	if err != nil {
-		log.Fatalln("Error generating tool pages: ", err)
+		return fmt.Errorf("error preparing static files: %w", err)
 	}
-}
-
-// generateProductpages generates all product pages of the category projects or software
-func generateProductpages(category string, folder string, tmpl *template.Template) error {
-	productIDs := getAllIDs(category)
-	if len(productIDs) > 0 {
-		// make project folder if doesn't exist
-		if _, err := os.Stat(buildDir + "/" + folder); os.IsNotExist(err) {
-			err := os.Mkdir(buildDir+"/"+folder, 0755)
-			if err != nil {
-				return err
-			}
+	// the asset function of the templates links to the files of this build
+	setAssets(index)
+	files, err := planAssets(static, index)
+	if err != nil {
+		return fmt.Errorf("error reading static files: %w", err)
+	}
+	pages, err := planPages(ctx, tmpl, index)
+	if err != nil {
+		return fmt.Errorf("error generating pages: %w", err)
+	}
+	files = append(files, pages...)
+	if cfg.Build.Compress {
+		files = append(files, compressedSiblings(files)...)
+	}
+	cache := loadBuildCache()
+	changes, err := diffBuild(cache, files)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		changes.print(os.Stdout)
+		return nil
+	}
+	workers := cfg.Build.Workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	written, err := writeBuildFiles(append(changes.added, changes.changed...), workers)
+	// the cache keeps the files written before an error, so the next build does not write them again
+	next := buildCache{Files: make(map[string]buildEntry, len(files))}
+	for _, file := range changes.unchanged {
+		next.Files[file.path] = cache.Files[file.path]
+	}
+	for path, entry := range written {
+		next.Files[path] = entry
+	}
+	saveErr := saveBuildCache(next)
+	if saveErr != nil {
+		appLog.Warn("could not save build cache", "error", saveErr)
+	}
+	if err != nil {
+		return err
+	}
+	err = removeStale(changes.deleted)
+	if err != nil {
+		return fmt.Errorf("error removing stale files: %w", err)
+	}
+	manifest := newManifest(next)
+	err = writeManifest(manifest)
+	if err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	appLog.Info("static build written", "added", len(changes.added), "changed", len(changes.changed),
+		"unchanged", len(changes.unchanged), "deleted", len(changes.deleted), "workers", workers,
+		"sha256", manifest.SHA256, "duration", time.Since(start).Round(time.Millisecond))
+	if cfg.Build.Check != "off" {
+		report, err := checkBuild(ctx)
+		if err != nil {
+			return fmt.Errorf("error checking links: %w", err)
 		}
-		for _, productID := range productIDs {
-			var page ProductPage
-			if category == projects {
-				page, _ = getProjectFromDatabase(productID)
-			} else if category == software {
-				page, _ = getToolFromDatabase(productID)
-			} else {
-				break
-			}
-			generatePage(tmpl.Lookup("product"), page, folder+"/"+productID+".html")
+		report.log()
+		if len(report.problems) > 0 && cfg.Build.Check == "fail" {
+			return fmt.Errorf("%w: %d problems", errLinksBroken, len(report.problems))
 		}
 	}
+	if cfg.Build.Archive != "" {
+		name, err := writeArchive(manifest)
+		if err != nil {
+			return fmt.Errorf("error writing archive: %w", err)
+		}
+		appLog.Info("static build archived", "file", name)
+	}
 	return nil
 }
 
-// copyDir copies a directory recursively from src directory to dst directory
-func copyDir(src string, dst string) error {
-
-	sInfo, err := os.Stat(src)
-	if err != nil {
-		return err
+// planAssets plans a file in the static folder of the build for every static file
+// prepared files are written minified under their fingerprinted names, the images are copied as they are
+func planAssets(fsys fs.FS, index *assetIndex) ([]buildFile, error) {
+	var files []buildFile
+	names := make([]string, 0, len(index.byName))
+	for name := range index.byName {
+		names = append(names, name)
 	}
-
-	_, err = os.Stat(dst)
-	if os.IsNotExist(err) {
-		err = os.MkdirAll(dst, sInfo.Mode())
+	sort.Strings(names)
+	for _, name := range names {
+		file := index.byName[name]
+		sum := sha256.Sum256(file.content)
+		files = append(files, buildFile{path: "static/" + file.url, input: hex.EncodeToString(sum[:]), content: func() ([]byte, error) {
+			return file.content, nil
+		}})
+	}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-	}
+		if d.IsDir() && name != "." && !isImagePath(name) {
+			return fs.SkipDir
+		}
+		// Skip directories and symlinks.
+		if d.IsDir() || d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		input, err := hashFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		files = append(files, buildFile{path: "static/" + name, input: input, content: func() ([]byte, error) {
+			return fs.ReadFile(fsys, name)
+		}})
+		return nil
+	})
+	return files, err
+}
 
-	entries, err := ioutil.ReadDir(src)
+// planPages loads the data of all pages from the database of the context and plans a file for every page
+// the pages depend on the templates, the links to the static files, the minification and the base path besides their data
+func planPages(ctx context.Context, tmpl *template.Template, index *assetIndex) ([]buildFile, error) {
+	render, err := hashTemplates()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	render += index.signature() + strconv.FormatBool(cfg.Build.Minify) + strconv.FormatBool(cfg.PrettyURLs) + basePath()
+	home, err := homeData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	files := []buildFile{
+		pageFile(tmpl, homeTempl, home, "index.html", render),
+		pageFile(tmpl, impTempl, impressumData(), pageFileName("impressum"), render),
+	}
+	for _, category := range []struct{ collection, folder string }{{projects, "project"}, {software, "tool"}} {
+		products, err := getAllProductPages(ctx, category.collection)
+		if err != nil {
+			return nil, fmt.Errorf("%s pages: %w", category.folder, err)
+		}
+		for _, product := range products {
+			files = append(files, pageFile(tmpl, productTempl, product.Page, pageFileName(category.folder+"/"+product.ID), render))
+		}
+	}
+	return files, nil
+}
 
-	for _, entry := range entries {
-		srcPath := filepath.Join(src, entry.Name())
-		dstPath := filepath.Join(dst, entry.Name())
-
-		if entry.IsDir() {
-			err = copyDir(srcPath, dstPath)
-			if err != nil {
-				return err
-			}
-		} else {
-			// Skip symlinks.
-			if entry.Mode()&os.ModeSymlink != 0 {
-				continue
-			}
+// pageFile plans a page rendered with a template, its input hash covers the render hash and the data of the page
+// data that cannot be hashed makes the page be written by every build
+func pageFile(tmpl *template.Template, name string, data interface{}, path string, render string) buildFile {
+	input := ""
+	doc, err := json.Marshal(data)
+	if err == nil {
+		sum := sha256.Sum256([]byte(render + "\x00" + name + "\x00" + string(doc)))
+		input = hex.EncodeToString(sum[:])
+	} else {
+		appLog.Warn("could not hash page data", "path", path, "error", err)
+	}
+	return buildFile{path: path, input: input, content: func() ([]byte, error) {
+		page, err := generatePage(tmpl.Lookup(name), data, path)
+		if err != nil {
+			return nil, err
+		}
+		return minifyContent("text/html", page)
+	}}
+}
 
-			err = copyFile(srcPath, dstPath)
-			if err != nil {
-				return err
+// writeBuildFiles writes the files with a pool of workers and returns the cache entries of the written files
+// after the first error no further files are started
+func writeBuildFiles(files []buildFile, workers int) (map[string]buildEntry, error) {
+	jobs := make(chan buildFile)
+	written := make(map[string]buildEntry, len(files))
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range jobs {
+				entry, err := writeBuildFile(file)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("%s: %w", file.path, err)
+				} else if err == nil {
+					written[file.path] = entry
+				}
+				mu.Unlock()
 			}
+		}()
+	}
+	for _, file := range files {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
 		}
+		jobs <- file
 	}
-	return nil
+	close(jobs)
+	wg.Wait()
+	return written, firstErr
+}
+
+// writeBuildFile writes a file of the build and returns its cache entry
+func writeBuildFile(file buildFile) (buildEntry, error) {
+	content, err := file.content()
+	if err != nil {
+		return buildEntry{}, err
+	}
+	target := filepath.Join(buildDir(), filepath.FromSlash(file.path))
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return buildEntry{}, err
+	}
+	err = os.WriteFile(target, content, 0644)
+	if err != nil {
+		return buildEntry{}, fmt.Errorf("error writing file: %w", err)
+	}
+	sum := sha256.Sum256(content)
+	return buildEntry{Input: file.input, Size: int64(len(content)), SHA256: hex.EncodeToString(sum[:])}, nil
+}
+
+// copyDir copies a directory recursively from src directory to dst directory
+func copyDir(src string, dst string) error {
+	return copyFS(os.DirFS(src), dst)
 }
 
 // copyFile copies a file from src directory to dst directory
@@ -141,19 +315,19 @@ func copyFile(src, dst string) error {
 	return out.Close()
 }
 
-// generatePage generates a single page and writes it to the buildDir using the given template and data and the given filename
-func generatePage(tmpl *template.Template, s interface{}, path string) {
-	log.Println("Generating page: " + path)
-	f, err := os.Create(buildDir + "/" + path)
-	if err != nil {
-		log.Fatalln("Error creating file: ", err)
-	}
-	err = tmpl.Execute(f, s)
-	if err != nil {
-		log.Fatalln("Error executing template: ", err)
+// generatePage renders a single page with the given template and data
+// the page is rendered completely before it is written, so a failing template leaves no half written page
+func generatePage(tmpl *template.Template, s interface{}, path string) ([]byte, error) {
+	appLog.Debug("generating page", "path", path)
+	if tmpl == nil {
+		return nil, fmt.Errorf("missing template for %s", path)
 	}
-	err = f.Close()
+	var buf bytes.Buffer
+	start := time.Now()
+	err := tmpl.Execute(&buf, s)
+	renderDuration.since(start, tmpl.Name())
 	if err != nil {
-		log.Fatalln("Error closing file: ", err)
+		return nil, fmt.Errorf("error executing template: %w", err)
 	}
+	return buf.Bytes(), nil
 }
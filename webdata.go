@@ -4,7 +4,11 @@
 */
 package main
 
-import "go.mongodb.org/mongo-driver/bson"
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"sync"
+)
 
 // Page data structure for the header and footer of every page
 type Page struct {
@@ -24,6 +28,13 @@ type Home struct {
 	Languages   []bson.M
 }
 
+// ErrorPage data structure for the error pages
+type ErrorPage struct {
+	Page
+	Status  int
+	Message string
+}
+
 // ProductPage data structure for the project and tool pages
 type ProductPage struct {
 	Page
@@ -35,31 +46,82 @@ type ProductPage struct {
 	Noproduct   bool
 }
 
-// getHTML returns the HTML returns the suffix for HTML-links if the pages are served statically
+// getHTML returns the suffix of the links to pages, it is the same in the static build and the web server with pretty URLs:
+// "/" with pretty URLs, otherwise ".html" if the pages are served statically and "" by the web server
 func getHTML() string {
 	html := ""
-	if st {
+	if cfg.PrettyURLs {
+		html = "/"
+	} else if cfg.Static {
 		html = ".html"
 	}
 	return html
 }
 
-// HomeData returns the data for the home page using the database
-func homeData() Home {
+// pageFileName returns the file of a page of the static build, e.g. project/foo.html or project/foo/index.html with pretty URLs
+func pageFileName(page string) string {
+	if cfg.PrettyURLs {
+		return page + "/index.html"
+	}
+	return page + ".html"
+}
+
+// HomeData returns the data for the home page using the database of the context
+// the queries run concurrently, the first failing one cancels the others
+func homeData(ctx context.Context) (Home, error) {
 	home := Home{
 		Page: Page{
 			Title: "Portfolio",
 			HTML:  getHTML(),
 			CSS:   "home",
 		},
-		Categories:  getAllProjectsInCategories(),
-		Education:   getEducationFromDatabase(),
-		ProgLang:    getProgLangFromDatabase(),
-		Software:    getSoftwareFromDatabase(),
-		OtherSkills: getOtherSkillsFromDatabase(),
-		Languages:   getLanguageFromDatabase(),
 	}
-	return home
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	run := func(load func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := load()
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	run(func() (err error) {
+		home.Categories, err = getAllProjectsInCategories(ctx)
+		return err
+	})
+	skills := []struct {
+		list *[]bson.M
+		get  func(ctx context.Context) ([]bson.M, error)
+	}{
+		{&home.Education, getEducationFromDatabase},
+		{&home.ProgLang, getProgLangFromDatabase},
+		{&home.Software, getSoftwareFromDatabase},
+		{&home.OtherSkills, getOtherSkillsFromDatabase},
+		{&home.Languages, getLanguageFromDatabase},
+	}
+	for _, skill := range skills {
+		skill := skill
+		run(func() (err error) {
+			*skill.list, err = skill.get(ctx)
+			return err
+		})
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return Home{}, firstErr
+	}
+	return home, nil
 }
 
 // impressumData returns the data for the impressum page
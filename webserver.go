@@ -7,70 +7,297 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
-	"log"
+	"html/template"
+	"io/fs"
 	"net/http"
-	"os"
-	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	//srcDir    = "./seiten" // Verzeichnis für Blog -Beiträge
-	tmplDir      = "./templates/" // HTML -Template Verzeichnis
-	templFile    = "*.templ.html"
 	homeTempl    = "home"
 	productTempl = "product"
 	impTempl     = "impressum"
 	errorTempl   = "error"
 )
 
+// statusClientClosed is logged for requests whose client went away before the answer, like nginx does
+const statusClientClosed = 499
+
+var (
+	// templates are the parsed templates of the web server, they are replaced in watch mode
+	templates    *template.Template
+	templatesMux sync.RWMutex
+)
+
+// setTemplates sets the templates used to render the pages
+func setTemplates(tmpl *template.Template) {
+	templatesMux.Lock()
+	defer templatesMux.Unlock()
+	templates = tmpl
+}
+
+// getTemplates returns the templates used to render the pages
+func getTemplates() *template.Template {
+	templatesMux.RLock()
+	defer templatesMux.RUnlock()
+	return templates
+}
+
+// newRouter returns a router that logs every request with its request ID and recovers from panics
+func newRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(requestIDMiddleware, requestLogMiddleware, gin.Recovery())
+	return router
+}
+
 // startWebserver starts the webserver on the specified port and sets up the routes
-func startWebServer() {
-	router := gin.Default()
-	log.Println("Load templates from: ", tmplDir)
-	router.LoadHTMLGlob(filepath.Join(tmplDir, "**/", templFile))
-	log.Println("Load static files from: ", statDir)
-	router.Static("/static", statDir)
-	log.Println("Set up routes")
+func startWebServer() error {
+	router := newRouter()
+	router.Use(metricsMiddleware, compressResponses)
+	appLog.Debug("load templates", "pattern", templatePattern)
+	tmpl, err := parseTemplates()
+	if err != nil {
+		return err
+	}
+	setTemplates(tmpl)
+	err = reloadAssets()
+	if err != nil {
+		return fmt.Errorf("could not prepare static files: %w", err)
+	}
+	setupCaches()
+	if cfg.Watch {
+		appLog.Info("watch mode, pages are reloaded on changes")
+		setupLiveReload(router)
+		startWatching(reloadTemplates)
+	}
+	appLog.Debug("load static files", "path", cfg.Paths.Static)
+	appLog.Debug("set up routes", "base_path", basePath())
 	router.NoRoute(pageNotFound)
-	router.GET("/", homeHandler)
-	router.GET("/impressum", impressumHandler)
-	router.GET("/project/:projectID", projectHandler)
-	router.GET("/tool/:toolID", toolHandler)
-	port := ":" + os.Getenv("PORT")
-	log.Printf("Listening on :%v ....", port)
-	err := router.Run(port)
+	// all routes are mounted under the path of the base URL
+	site := router.Group(basePath())
+	staticFiles, err := staticFS()
 	if err != nil {
-		log.Fatalln("Error starting web server: ", err)
+		return fmt.Errorf("could not prepare static files: %w", err)
+	}
+	static := assetHandler(staticFiles)
+	site.GET("/static/*filepath", static)
+	site.HEAD("/static/*filepath", static)
+	handlePage(site, "/", withDeadline(cfg.Server.HomeTimeout), homeHandler)
+	handlePage(site, "/impressum", withDeadline(cfg.Server.PageTimeout), impressumHandler)
+	handlePage(site, "/project/:projectID", withDeadline(cfg.Server.PageTimeout), projectHandler)
+	handlePage(site, "/tool/:toolID", withDeadline(cfg.Server.PageTimeout), toolHandler)
+	setupHealthRoutes(site)
+	site.GET(metricsPath, metricsHandler)
+	err = setupAdminRoutes(site)
+	if err != nil {
+		return err
+	}
+	redirectToBasePath(router)
+	return serve(router)
+}
+
+// handlePage registers a page under every form of its URL: with and without .html, a trailing slash or index.html
+// a parameter at the end also matches the .html form, requests to other forms than the canonical one are redirected
+func handlePage(router gin.IRouter, relativePath string, handlers ...gin.HandlerFunc) {
+	handlers = append([]gin.HandlerFunc{redirectToCanonical}, handlers...)
+	if relativePath == "/" {
+		router.GET("/", handlers...)
+		router.GET("/index.html", handlers...)
+		return
+	}
+	router.GET(relativePath, handlers...)
+	router.GET(relativePath+"/", handlers...)
+	router.GET(relativePath+"/index.html", handlers...)
+	if !strings.Contains(relativePath, ":") {
+		router.GET(relativePath+".html", handlers...)
+	}
+}
+
+// redirectToCanonical redirects a page to its canonical URL, the form the pages link to
+func redirectToCanonical(c *gin.Context) {
+	canonical := canonicalPath(c.Request.URL.Path)
+	if canonical == c.Request.URL.Path {
+		c.Next()
+		return
+	}
+	if c.Request.URL.RawQuery != "" {
+		canonical += "?" + c.Request.URL.RawQuery
+	}
+	c.Redirect(http.StatusMovedPermanently, canonical)
+	c.Abort()
+}
+
+// canonicalPath returns the canonical path of a page: with a trailing slash for pretty URLs and without .html otherwise
+func canonicalPath(p string) string {
+	p = strings.TrimSuffix(p, "/index.html")
+	p = strings.TrimSuffix(p, ".html")
+	p = strings.TrimSuffix(p, "/")
+	if p == basePath() {
+		return p + "/"
+	}
+	return p + getHTML()
+}
+
+// redirectToBasePath redirects the root to the base path if the site is not served at the root
+func redirectToBasePath(router *gin.Engine) {
+	if basePath() == "" {
+		return
+	}
+	router.GET("/", func(c *gin.Context) {
+		c.Redirect(http.StatusFound, basePath()+"/")
+	})
+}
+
+// withDeadline returns a middleware that limits the handlers after it to the timeout,
+// the database calls of the handlers stop when it is over
+func withDeadline(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
 	}
 }
 
 // toolHandler handles the request for a tool page, used from software-sites
-func toolHandler(context *gin.Context) {
-	tool, status := getToolFromDatabase(context.Param("toolID"))
-	context.HTML(status, productTempl, tool)
+func toolHandler(c *gin.Context) {
+	id := c.Param("toolID")
+	servePage(c, productTempl, func(ctx context.Context) (int, interface{}, error) {
+		tool, err := cachedQuery(ctx, "tool/"+id, func() (interface{}, error) {
+			return getToolFromDatabase(ctx, id)
+		})
+		return productStatus(tool, err)
+	})
 }
 
 // projectHandler handles the request for a project page, used from project-sites
-func projectHandler(context *gin.Context) {
-	product, status := getProjectFromDatabase(context.Param("projectID"))
-	context.HTML(status, productTempl, product)
+func projectHandler(c *gin.Context) {
+	id := c.Param("projectID")
+	servePage(c, productTempl, func(ctx context.Context) (int, interface{}, error) {
+		product, err := cachedQuery(ctx, "project/"+id, func() (interface{}, error) {
+			return getProjectFromDatabase(ctx, id)
+		})
+		return productStatus(product, err)
+	})
+}
+
+// productStatus returns the status of a project or tool page, a missing product is answered with its not found page
+func productStatus(product interface{}, err error) (int, interface{}, error) {
+	if errors.Is(err, errNotFound) {
+		return http.StatusNotFound, product, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, product, nil
 }
 
 // impressumHandler handles the request for the impressum page
-func impressumHandler(context *gin.Context) {
-	ps := impressumData()
-	context.HTML(http.StatusOK, impTempl, ps)
+func impressumHandler(c *gin.Context) {
+	servePage(c, impTempl, func(ctx context.Context) (int, interface{}, error) {
+		return http.StatusOK, impressumData(), nil
+	})
 }
 
 // pageNotFound handles the request for a page that does not exist
 func pageNotFound(c *gin.Context) {
-	ps := Page{Title: "Page not found"}
-	c.HTML(http.StatusNotFound, errorTempl, ps)
+	renderErrorPage(c, http.StatusNotFound, "Page not found")
 }
 
 // homeHandler handles the request for the home page
 func homeHandler(c *gin.Context) {
-	home := homeData()
-	c.HTML(http.StatusOK, homeTempl, home)
+	servePage(c, homeTempl, func(ctx context.Context) (int, interface{}, error) {
+		home, err := cachedQuery(ctx, "home", func() (interface{}, error) {
+			return homeData(ctx)
+		})
+		return http.StatusOK, home, err
+	})
+}
+
+// requestTemplates returns the templates a request is rendered with, preview requests carry the templates of their upload job
+func requestTemplates(c *gin.Context) *template.Template {
+	if tmpl, ok := c.Get(templatesKey); ok {
+		return tmpl.(*template.Template)
+	}
+	return getTemplates()
+}
+
+// renderTemplate renders a template of the request into a buffer, so a failing template never sends half a page
+func renderTemplate(c *gin.Context, name string, data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	tmpl := requestTemplates(c)
+	if tmpl == nil {
+		return nil, fmt.Errorf("templates are not loaded")
+	}
+	start := time.Now()
+	err := tmpl.ExecuteTemplate(&buf, name, data)
+	renderDuration.since(start, name)
+	if err != nil {
+		return nil, fmt.Errorf("error rendering %s: %w", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// renderError logs the error and answers with 504 if the deadline of the request is over,
+// with 503 if the database is unreachable and with 500 otherwise
+// nothing is sent if the client has gone away
+func renderError(c *gin.Context, err error) {
+	_ = c.Error(err)
+	switch c.Request.Context().Err() {
+	case context.Canceled:
+		logFor(c.Request.Context()).Info("request cancelled by client", "path", c.Request.URL.Path, "error", err)
+		c.AbortWithStatus(statusClientClosed)
+		return
+	case context.DeadlineExceeded:
+		logFor(c.Request.Context()).Error("page deadline exceeded", "path", c.Request.URL.Path, "error", err)
+		renderErrorPage(c, http.StatusGatewayTimeout, "The page took too long to load")
+		return
+	}
+	logFor(c.Request.Context()).Error("could not serve page", "path", c.Request.URL.Path, "error", err)
+	if isUnavailable(err) {
+		c.Header("Retry-After", "30")
+		renderErrorPage(c, http.StatusServiceUnavailable, "Service temporarily unavailable")
+		return
+	}
+	renderErrorPage(c, http.StatusInternalServerError, "Something went wrong")
+}
+
+// renderErrorPage renders the error page, if that fails too a plain text message is sent
+func renderErrorPage(c *gin.Context, status int, message string) {
+	page := ErrorPage{
+		Page:    Page{Title: message, HTML: getHTML()},
+		Status:  status,
+		Message: message,
+	}
+	var buf bytes.Buffer
+	tmpl := requestTemplates(c)
+	if tmpl != nil {
+		start := time.Now()
+		err := tmpl.ExecuteTemplate(&buf, errorTempl, page)
+		renderDuration.since(start, errorTempl)
+		if err == nil {
+			c.Data(status, "text/html; charset=utf-8", buf.Bytes())
+			return
+		}
+		logFor(c.Request.Context()).Error("could not render error page", "error", err)
+	}
+	c.String(status, "%d %s", status, message)
+}
+
+// dataContext returns the context for the database calls of a request, it ends with the request
+// preview requests carry the database and images of their upload job, all other requests use the live ones
+func dataContext(c *gin.Context) context.Context {
+	ctx := withDatabase(c.Request.Context(), c.GetString(databaseKey))
+	if images, ok := c.Get(imagesKey); ok {
+		ctx = withImages(ctx, images.(fs.FS))
+	}
+	return ctx
 }
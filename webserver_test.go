@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pageRouter returns a router with the pages of the web server under the base URL, every page answers with 200
+func pageRouter(baseURL string, prettyURLs bool) *gin.Engine {
+	cfg.BaseURL = baseURL
+	cfg.PrettyURLs = prettyURLs
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	site := router.Group(basePath())
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	handlePage(site, "/", ok)
+	handlePage(site, "/impressum", ok)
+	handlePage(site, "/project/:projectID", ok)
+	redirectToBasePath(router)
+	return router
+}
+
+func TestCanonicalRedirects(t *testing.T) {
+	defer func() {
+		cfg.BaseURL = defaultConfig().BaseURL
+		cfg.PrettyURLs = false
+	}()
+	tests := []struct {
+		baseURL  string
+		pretty   bool
+		path     string
+		status   int
+		location string
+	}{
+		{"", false, "/", http.StatusOK, ""},
+		{"", false, "/index.html", http.StatusMovedPermanently, "/"},
+		{"", false, "/impressum", http.StatusOK, ""},
+		{"", false, "/impressum/", http.StatusMovedPermanently, "/impressum"},
+		{"", false, "/impressum.html", http.StatusMovedPermanently, "/impressum"},
+		{"", false, "/impressum/index.html", http.StatusMovedPermanently, "/impressum"},
+		{"", false, "/impressum.html?lang=de", http.StatusMovedPermanently, "/impressum?lang=de"},
+		{"", false, "/project/foo", http.StatusOK, ""},
+		{"", false, "/project/foo.html", http.StatusMovedPermanently, "/project/foo"},
+		{"", false, "/project/foo/", http.StatusMovedPermanently, "/project/foo"},
+		{"", false, "/project/foo/index.html", http.StatusMovedPermanently, "/project/foo"},
+		{"", true, "/", http.StatusOK, ""},
+		{"", true, "/index.html", http.StatusMovedPermanently, "/"},
+		{"", true, "/impressum", http.StatusMovedPermanently, "/impressum/"},
+		{"", true, "/impressum/", http.StatusOK, ""},
+		{"", true, "/impressum.html", http.StatusMovedPermanently, "/impressum/"},
+		{"", true, "/impressum/index.html", http.StatusMovedPermanently, "/impressum/"},
+		{"", true, "/project/foo", http.StatusMovedPermanently, "/project/foo/"},
+		{"", true, "/project/foo.html", http.StatusMovedPermanently, "/project/foo/"},
+		{"", true, "/project/foo/", http.StatusOK, ""},
+		{"https://example.com/portfolio/", false, "/", http.StatusFound, "/portfolio/"},
+		{"https://example.com/portfolio/", false, "/portfolio/", http.StatusOK, ""},
+		{"https://example.com/portfolio/", false, "/portfolio/index.html", http.StatusMovedPermanently, "/portfolio/"},
+		{"https://example.com/portfolio/", false, "/portfolio/impressum", http.StatusOK, ""},
+		{"https://example.com/portfolio/", false, "/portfolio/impressum/", http.StatusMovedPermanently, "/portfolio/impressum"},
+		{"https://example.com/portfolio/", false, "/portfolio/project/foo.html", http.StatusMovedPermanently, "/portfolio/project/foo"},
+		{"https://example.com/portfolio/", true, "/portfolio/", http.StatusOK, ""},
+		{"https://example.com/portfolio/", true, "/portfolio/index.html", http.StatusMovedPermanently, "/portfolio/"},
+		{"https://example.com/portfolio/", true, "/portfolio/impressum", http.StatusMovedPermanently, "/portfolio/impressum/"},
+		{"https://example.com/portfolio/", true, "/portfolio/project/foo", http.StatusMovedPermanently, "/portfolio/project/foo/"},
+	}
+	for _, tt := range tests {
+		router := pageRouter(tt.baseURL, tt.pretty)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+			t.Errorf("base %q, pretty %v: GET %s = %d %q, want %d %q",
+				tt.baseURL, tt.pretty, tt.path, w.Code, w.Header().Get("Location"), tt.status, tt.location)
+			continue
+		}
+		// the redirect must lead to the page itself and never to another redirect
+		if tt.location != "" {
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.location, nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("base %q, pretty %v: GET %s after redirect from %s = %d %q, want 200",
+					tt.baseURL, tt.pretty, tt.location, tt.path, w.Code, w.Header().Get("Location"))
+			}
+		}
+	}
+}